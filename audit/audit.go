@@ -0,0 +1,59 @@
+// Package audit writes the JSON lines audit log of the tunnelled connections.
+package audit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/rotate"
+)
+
+// Record is a line of the audit log. The server has the client and the agent, the agent has the resolved IP.
+type Record struct {
+	Time          time.Time `json:"time"`
+	ClientAddr    string    `json:"client_addr,omitempty"`
+	User          string    `json:"user,omitempty"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	AgentAddr     string    `json:"agent_addr,omitempty"`
+	StreamID      uint32    `json:"stream_id,omitempty"`
+	Dst           string    `json:"dst"`
+	ResolvedIP    string    `json:"resolved_ip,omitempty"`
+	Result        string    `json:"result"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Duration      float64   `json:"duration"`
+}
+
+// Log is an append-only JSON lines log of the tunnelled connections, rotated by size.
+type Log struct {
+	file *rotate.File
+}
+
+// Open opens the audit log for appending. With maxSize 0 the log is never rotated.
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	f, err := rotate.Open(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f}, nil
+}
+
+// Write appends the record to the log. It does nothing on a nil log.
+func (l *Log) Write(rec *Record) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
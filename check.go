@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/metala/revwebsocks5/client"
+	"github.com/spf13/cobra"
+)
+
+var checkJSON bool
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks the connection to the server step by step",
+	Long: `The check connects to the server endpoints as the client does and reports each step:
+the DNS resolution, each proxy of the chain, the TLS handshake, the WebSocket upgrade and the authentication.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := newClientConfig()
+		if err != nil {
+			fatal("Failed to load the endpoints", err)
+		}
+		c, err := client.New(cfg)
+		if err != nil {
+			fatal("Invalid configuration", err)
+		}
+		report := c.Check()
+		if checkJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(report); err != nil {
+				fatal("Failed to write the report", err)
+			}
+		} else {
+			report.Print(os.Stdout)
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	addConnectFlags(checkCmd.Flags())
+	checkCmd.Flags().BoolVarP(&checkJSON, "json", "", false, "print the report as JSON")
+
+	checkCmd.MarkFlagRequired("password")
+}
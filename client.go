@@ -1,22 +1,17 @@
 package main
 
 import (
-	"crypto/x509"
 	"errors"
-	"io"
-	"log"
-	"net"
-	"net/http"
-	"net/url"
-	"os"
+	"log/slog"
 	"time"
 
-	socks5 "github.com/armon/go-socks5"
-	"github.com/hashicorp/yamux"
-	tls "github.com/refraction-networking/utls"
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/client"
+	"github.com/metala/revwebsocks5/metrics"
+	"github.com/metala/revwebsocks5/proxy"
+	"github.com/metala/revwebsocks5/spy"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/proxy"
-	"golang.org/x/net/websocket"
+	"github.com/spf13/pflag"
 )
 
 // clientCmd represents the client command
@@ -25,193 +20,167 @@ var clientCmd = &cobra.Command{
 	Short: "Client connects to server",
 	Long:  `The client connects to the server and acts as an exit node for the tunnel.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		connectUrl, err := url.Parse(connect)
+		cfg, err := newClientConfig()
 		if err != nil {
-			log.Fatal(err)
+			fatal("Failed to load the endpoints", err)
 		}
-		if userAgent == "" {
-			userAgent = "curl/8.1.2"
+		if reconnectDelay < 1 || reconnectMaxDelay < 1 || reconnectReset < 1 {
+			fatal("Invalid reconnection delay", errors.New("the reconnection delays must be at least 1 second"))
 		}
-		proxyURLs := make([]*url.URL, 0)
-		for _, pu := range proxies {
-			u, err := url.Parse(pu)
-			if err != nil {
-				log.Fatalf("Invalid proxy '%s': %s", pu, err)
+		egress, err := client.NewEgress(egressBind, egressInterface)
+		if err != nil {
+			fatal("Invalid egress", err)
+		}
+		if cfg.Resolver, err = client.NewResolver(resolverAddress, egress.DialContext, tlsKeyLog); err != nil {
+			fatal("Invalid resolver", err)
+		}
+		cfg.Dial = egress.DialContext
+		cfg.FailbackInterval = time.Duration(failbackInterval) * time.Second
+		cfg.ReconnectLimit = reconnectLimit
+		cfg.ReconnectDelay = time.Duration(reconnectDelay) * time.Second
+		cfg.ReconnectMaxDelay = time.Duration(reconnectMaxDelay) * time.Second
+		cfg.ReconnectReset = time.Duration(reconnectReset) * time.Second
+		cfg.AuthFailureLimit = authFailureLimit
+		cfg.ShutdownTimeout = shutdownTimeout
+		if auditLogFile != "" {
+			if cfg.Audit, err = audit.Open(auditLogFile, auditLogMaxSize<<20, auditLogMaxBackups); err != nil {
+				fatal("Failed to open the audit log", err)
+			}
+			defer cfg.Audit.Close()
+		}
+		if metricsListen != "" {
+			cfg.Metrics = metrics.NewRegistry()
+			if err := serveMetrics(metricsListen, cfg.Metrics); err != nil {
+				fatal("Failed to serve metrics", err)
 			}
-			proxyURLs = append(proxyURLs, u)
 		}
-		certPool, err := loadCertPool(tlsCert)
+		if captureFile != "" {
+			if cfg.Capture, err = spy.OpenCapture(captureFile, captureStreams); err != nil {
+				fatal("Failed to open the capture", err)
+			}
+		}
+		c, err := client.New(cfg)
 		if err != nil {
-			log.Fatal(err)
+			fatal("Invalid configuration", err)
 		}
-		for i := 0; i <= reconnectLimit; i++ {
-			log.Printf("Connecting to the server. Attempt %d of %d", i, reconnectLimit)
-			err := clientConnect(connectUrl, proxyURLs, certPool, tlsSkipVerify)
+		if localListen != "" {
+			ln, err := listenAddr(localListen)
 			if err != nil {
-				log.Printf("Failed to connect: %s", err)
+				fatal("Failed to listen", err)
 			}
-			log.Printf("Sleeping for %d sec...", reconnectDelay)
-			tsleep := time.Second * time.Duration(reconnectDelay)
-			time.Sleep(tsleep)
+			slog.Info("Serving local SOCKS5 clients", "listen", localListen)
+			go func() {
+				if err := c.ServeSocks(ln); err != nil {
+					slog.Error("Local SOCKS5 listener failed", "err", err)
+				}
+			}()
 		}
-
-		log.Fatal("Ending...")
+		err = c.Run(cmd.Context())
+		if err := cfg.Capture.Close(); err != nil {
+			slog.Warn("Failed to write the capture", "err", err)
+		}
+		if err != nil {
+			fatal("Client failed", err)
+		}
+		slog.Info("Client stopped")
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(clientCmd)
 
-	clientCmd.Flags().StringVarP(&connect, "connect", "c", "", "connect address:port")
-	clientCmd.Flags().StringSliceVarP(&proxies, "proxy", "", []string{}, "proxy address:port")
-	clientCmd.Flags().StringVarP(&password, "password", "P", "", "Connect password")
-	clientCmd.Flags().StringVarP(&userAgent, "user-agent", "", "", "User-Agent")
-	clientCmd.Flags().IntVarP(&reconnectLimit, "reconnect-limit", "", 3, "reconnection limit")
-	clientCmd.Flags().IntVarP(&reconnectDelay, "reconnect-delay", "", 30, "reconnection delay")
-	clientCmd.Flags().StringVarP(&tlsCert, "tls-cert", "", "", "certificate file (defaults to system certificates)")
-	clientCmd.Flags().BoolVarP(&tlsSkipVerify, "tls-skip-verify", "", false, "verify TLS server")
+	addConnectFlags(clientCmd.Flags())
+	clientCmd.Flags().IntVarP(&failbackInterval, "failback-interval", "", 300, "seconds between checks of the preferred endpoint (0 to disable)")
+	clientCmd.Flags().IntVarP(&reconnectLimit, "reconnect-limit", "", 3, "consecutive failed reconnection limit (0 for unlimited)")
+	clientCmd.Flags().IntVarP(&reconnectDelay, "reconnect-delay", "", 5, "initial reconnection delay in seconds")
+	clientCmd.Flags().IntVarP(&reconnectMaxDelay, "reconnect-max-delay", "", 300, "maximum reconnection delay in seconds")
+	clientCmd.Flags().IntVarP(&reconnectReset, "reconnect-reset", "", 60, "seconds of healthy session that reset the reconnection backoff")
+	clientCmd.Flags().IntVarP(&authFailureLimit, "auth-failure-limit", "", 3, "consecutive rejected authentication limit (0 for unlimited)")
 
-	clientCmd.MarkFlagsRequiredTogether("connect", "password")
-}
+	clientCmd.Flags().StringVarP(&egressBind, "egress-bind", "", "", "source address of the outbound connections")
+	clientCmd.Flags().StringVarP(&egressInterface, "egress-interface", "", "", "network interface of the outbound connections (Linux only)")
+	clientCmd.Flags().StringVarP(&resolverAddress, "resolver", "", "", "DNS server as ip[:port], tcp://ip[:port], tls://host[:port] or https://host/path")
 
-func clientConnect(connect *url.URL, proxyUrls []*url.URL, certPool *x509.CertPool, skipVerify bool) error {
-	socksHandler, err := socks5.New(&socks5.Config{})
-	if err != nil {
-		return err
-	}
+	clientCmd.Flags().StringVarP(&localListen, "listen", "l", "", "local SOCKS5 listen address:port or unix:/path")
+	clientCmd.Flags().StringVarP(&socketMode, "socket-mode", "", "", "unix socket file mode (e.g. 0660)")
+	clientCmd.Flags().StringVarP(&socketOwner, "socket-owner", "", "", "unix socket owner as user[:group]")
 
-	var dailer proxy.Dialer = proxy.Direct
-	if len(proxyUrls) > 0 {
-		for _, u := range proxyUrls {
-			d, err := proxy.FromURL(u, dailer)
-			if err != nil {
-				return err
-			}
-			dailer = d
-		}
-	}
+	clientCmd.Flags().StringVarP(&metricsListen, "metrics-listen", "", "", "Prometheus /metrics listen address:port or unix:/path")
+	clientCmd.Flags().StringVarP(&captureFile, "capture", "", "", "pcapng file capturing the decrypted tunnel connection")
+	clientCmd.Flags().BoolVarP(&captureStreams, "capture-streams", "", false, "also capture the tunnelled streams as their own flows")
+	clientCmd.Flags().StringVarP(&auditLogFile, "audit-log", "", "", "JSON lines audit log of the SOCKS5 destinations")
+	clientCmd.Flags().Int64VarP(&auditLogMaxSize, "audit-log-max-size", "", 100, "audit log size in MB triggering the rotation (0 to disable)")
+	clientCmd.Flags().IntVarP(&auditLogMaxBackups, "audit-log-max-backups", "", 5, "rotated audit logs to keep")
 
-	log.Println("Dialling...")
-	var conn net.Conn
-	if conn, err = dailer.Dial("tcp", connect.Host); err != nil {
-		return err
-	}
-	if debug && len(proxyUrls) == 0 {
-		logger := log.New(os.Stderr, "[conn raw] ", log.LstdFlags)
-		conn = newNetConnSpy(conn, logger)
-	}
+	clientCmd.Flags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", 30*time.Second, "time to drain connections on shutdown")
 
-	log.Println("Establishing TLS connection...")
-	tlsCfg := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		MaxVersion:         tls.VersionTLS13,
-		RootCAs:            certPool,
-		InsecureSkipVerify: skipVerify,
-		ServerName:         connect.Hostname(),
-		NextProtos:         []string{"h2", "http/1.1"},
-	}
-	conntls := tls.UClient(conn, tlsCfg, tls.HelloCustom)
-	conntls.ApplyPreset(&tls.ClientHelloSpec{
-		TLSVersMin: tls.VersionTLS12,
-		TLSVersMax: tls.VersionTLS13,
-		CipherSuites: []uint16{
-			0x1302, 0x1303, 0x1301, 0xc02c, 0xc030, 0x009f, 0xcca9, 0xcca8,
-			0xccaa, 0xc02b, 0xc02f, 0x009e, 0xc024, 0xc028, 0x006b, 0xc023,
-			0xc027, 0x0067, 0xc014, 0x0039, 0xc009, 0xc013, 0x0033, 0x009d,
-			0x009d, 0x009c, 0x003d, 0x003c, 0x0035, 0x002f, 0x00ff,
-		},
-		CompressionMethods: []uint8{0},
-		Extensions: []tls.TLSExtension{
-			&tls.SNIExtension{ServerName: connect.Hostname()},
-			&tls.SupportedPointsExtension{SupportedPoints: []uint8{0, 1, 2}},
-			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{
-				/* x25519 */ 0x001d /* secp256r1 */, 0x0017 /* x448 */, 0x001e /*secp521r1*/, 0x0019,
-				0x0018, 0x0100, 0x0101, 0x0102, 0x0103, 0x0104,
-			}},
-			&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
-			&tls.GenericExtension{Id: 22},
-			&tls.UtlsExtendedMasterSecretExtension{},
-			&tls.GenericExtension{Id: 49},
-			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
-				0x0403, 0x0503, 0x0603, 0x0807, 0x0808, 0x0809, 0x080a, 0x080b,
-				0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0303, 0x0301,
-				0x0302, 0x0402, 0x0502, 0x0602,
-			}},
-			&tls.SupportedVersionsExtension{Versions: []uint16{
-				tls.VersionTLS13, tls.VersionTLS12,
-			}},
-			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{
-				tls.PskModeDHE,
-			}},
-			&tls.KeyShareExtension{
-				KeyShares: []tls.KeyShare{
-					{Group: tls.X25519},
-				},
-			},
-			&tls.UtlsPaddingExtension{PaddingLen: 174, WillPad: true},
-		},
-	})
-	if err := conntls.Handshake(); err != nil {
-		log.Printf("Error connect: %v", err)
-		return err
-	}
-	conn = conntls
-	if debug {
-		logger := log.New(os.Stderr, "[conn] ", log.LstdFlags)
-		conn = newNetConnSpy(conn, logger)
-	}
-	rwc := io.ReadWriteCloser(conn)
+	clientCmd.MarkFlagRequired("password")
+}
 
-	log.Println("Starting tunnel client...")
-	wsConf := websocket.Config{
-		Location: connect,
-		Origin:   connect,
-		Version:  13,
-		Header: http.Header{
-			"User-Agent":    []string{userAgent},
-			"Authorization": []string{password},
-			"Connection":    []string{"Upgrade"},
-		},
-	}
-	wsconn, err := websocket.NewClient(&wsConf, rwc)
-	if err != nil {
-		return err
-	}
-	log.Println("Starting tunnel session...")
-	session, err := yamux.Server(wsconn, nil)
-	if err != nil {
-		return err
-	}
+// addConnectFlags adds the flags connecting to the server, shared by the client and check commands.
+func addConnectFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(&connects, "connect", "c", []string{}, "connect URL, repeat in order of priority")
+	flags.StringVarP(&endpointsFile, "endpoints", "", "", "JSON file with the server endpoints in order of priority")
+	flags.StringSliceVarP(&proxies, "proxy", "", []string{}, "proxy address:port")
+	flags.StringVarP(&proxyCredentials, "proxy-credentials", "", "", "netrc formatted file with the proxy credentials")
+	flags.StringVarP(&proxyTLSCert, "proxy-tls-cert", "", "", "https:// proxy certificate file (defaults to system certificates)")
+	flags.StringSliceVarP(&proxyTLSPins, "proxy-tls-pin", "", []string{}, "pinned https:// proxy public key as sha256//<base64>")
+	flags.BoolVarP(&proxyTLSSkipVerify, "proxy-tls-skip-verify", "", false, "skip the https:// proxy TLS verification")
+	flags.StringVarP(&proxyPAC, "proxy-pac", "", "", "PAC file or URL choosing the proxy")
+	flags.BoolVarP(&proxyFromEnvironment, "proxy-from-env", "", false, "use the proxy from HTTPS_PROXY/HTTP_PROXY/ALL_PROXY and NO_PROXY")
+	flags.StringVarP(&password, "password", "P", "", "Connect password")
+	flags.StringVarP(&userAgent, "user-agent", "", "", "User-Agent")
+	flags.StringVarP(&tlsCert, "tls-cert", "", "", "certificate file (defaults to system certificates)")
+	flags.BoolVarP(&tlsSkipVerify, "tls-skip-verify", "", false, "verify TLS server")
+	flags.StringSliceVarP(&tlsPins, "tls-pin", "", []string{}, "pinned server public key as sha256//<base64>")
+	flags.StringVarP(&tlsKeyLogFile, "tls-keylog", "", "", "file logging the TLS secrets for decrypting captures (defaults to SSLKEYLOGFILE)")
+}
 
-	log.Println("Accepting connections to SOCKS5 server...")
-	for {
-		stream, err := session.Accept()
-		if err != nil {
-			return err
-		}
-		log.Println("Serving new SOCKS5 connection...")
-		go func() {
-			err = socksHandler.ServeConn(stream)
-			if err != nil {
-				log.Println(err)
-			}
-		}()
+// newClientConfig returns the client configuration of the flags connecting to the server,
+// shared by the client and check commands.
+func newClientConfig() (client.Config, error) {
+	endpoints, err := loadEndpoints()
+	if err != nil {
+		return client.Config{}, err
 	}
+	return client.Config{
+		Endpoints:            endpoints,
+		Password:             password,
+		UserAgent:            userAgent,
+		ProxyFromEnvironment: proxyFromEnvironment,
+		Proxy: proxy.Config{
+			Credentials:   proxyCredentials,
+			TLSCert:       proxyTLSCert,
+			TLSPins:       proxyTLSPins,
+			TLSSkipVerify: proxyTLSSkipVerify,
+		},
+		KeyLogWriter: tlsKeyLog,
+		Tracer:       tracer,
+	}, nil
 }
 
-func loadCertPool(filename string) (*x509.CertPool, error) {
-	if filename == "" {
-		return x509.SystemCertPool()
+// loadEndpoints returns the endpoints in priority order, from the endpoints file and the --connect URLs.
+// The --connect endpoints share the proxy and TLS flags.
+func loadEndpoints() ([]*client.Endpoint, error) {
+	var endpoints []*client.Endpoint
+	if endpointsFile != "" {
+		var err error
+		if endpoints, err = client.LoadEndpoints(endpointsFile); err != nil {
+			return nil, err
+		}
 	}
-
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
+	for _, c := range connects {
+		endpoints = append(endpoints, &client.Endpoint{
+			URL:           c,
+			Proxies:       proxies,
+			ProxyPAC:      proxyPAC,
+			TLSCert:       tlsCert,
+			TLSPins:       tlsPins,
+			TLSSkipVerify: tlsSkipVerify,
+		})
 	}
-	certs := x509.NewCertPool()
-	ok := certs.AppendCertsFromPEM(data)
-	if !ok {
-		return nil, errors.New("failed to parse RootCAs")
+	if len(endpoints) == 0 {
+		return nil, errors.New("no server endpoints, use --connect or --endpoints")
 	}
-	return certs, nil
+	return endpoints, nil
 }
@@ -0,0 +1,25 @@
+//go:build linux
+
+package client
+
+import (
+	"syscall"
+)
+
+func checkBindToDevice() error {
+	return nil
+}
+
+// bindToDevice returns the net.Dialer control binding the socket to the interface (SO_BINDTODEVICE).
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"syscall"
+)
+
+func checkBindToDevice() error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
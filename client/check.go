@@ -0,0 +1,327 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/metala/revwebsocks5/internal/tlsutil"
+	"github.com/metala/revwebsocks5/proxy"
+	tls "github.com/refraction-networking/utls"
+	xproxy "golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// CheckReport is the result of the connection checks of the endpoints.
+type CheckReport struct {
+	OK        bool             `json:"ok"`
+	Endpoints []*EndpointCheck `json:"endpoints"`
+}
+
+// EndpointCheck is the result of the steps connecting to an endpoint, which stop at the first failure.
+type EndpointCheck struct {
+	URL   string       `json:"url"`
+	OK    bool         `json:"ok"`
+	Steps []*CheckStep `json:"steps"`
+}
+
+// CheckStep is a step of the connection, with the details it reports.
+type CheckStep struct {
+	Name    string        `json:"name"`
+	Target  string        `json:"target"`
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Details []CheckDetail `json:"details,omitempty"`
+}
+
+type CheckDetail struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (s *CheckStep) add(key, format string, args ...interface{}) {
+	s.Details = append(s.Details, CheckDetail{Key: key, Value: fmt.Sprintf(format, args...)})
+}
+
+func (c *EndpointCheck) step(name, target string) *CheckStep {
+	s := &CheckStep{Name: name, Target: target}
+	c.Steps = append(c.Steps, s)
+	return s
+}
+
+// pass marks the step passed, or failed with err, and returns whether it passed.
+func (c *EndpointCheck) pass(s *CheckStep, err error) bool {
+	if err != nil {
+		s.Error = err.Error()
+		c.OK = false
+		return false
+	}
+	s.OK = true
+	return true
+}
+
+// Print prints the report in a human readable form.
+func (r *CheckReport) Print(w io.Writer) {
+	for _, c := range r.Endpoints {
+		fmt.Fprintf(w, "%s\n", c.URL)
+		for _, s := range c.Steps {
+			result := "PASS"
+			if !s.OK {
+				result = "FAIL"
+			}
+			fmt.Fprintf(w, "  [%s] %s %s\n", result, s.Name, s.Target)
+			for _, d := range s.Details {
+				fmt.Fprintf(w, "         %s: %s\n", d.Key, d.Value)
+			}
+			if s.Error != "" {
+				fmt.Fprintf(w, "         error: %s\n", s.Error)
+			}
+		}
+	}
+	if r.OK {
+		fmt.Fprintln(w, "All checks passed.")
+	} else {
+		fmt.Fprintln(w, "Some checks failed.")
+	}
+}
+
+// Check connects to the endpoints as the client does, and reports each step: the DNS resolution,
+// each proxy of the chain, the TLS handshake, the WebSocket upgrade and the authentication.
+func (cl *Client) Check() *CheckReport {
+	report := &CheckReport{OK: true}
+	for _, ep := range cl.cfg.Endpoints {
+		c := cl.checkEndpoint(ep)
+		report.Endpoints = append(report.Endpoints, c)
+		report.OK = report.OK && c.OK
+	}
+	return report
+}
+
+// checkEndpoint walks the connection to the endpoint hop by hop.
+// Only the first proxy chain of a PAC result is checked.
+func (cl *Client) checkEndpoint(ep *Endpoint) *EndpointCheck {
+	c := &EndpointCheck{URL: ep.URL, OK: true}
+
+	chain := ep.proxyURLs
+	if ep.pac != nil {
+		s := c.step("pac", ep.ProxyPAC)
+		result, err := ep.pac.FindProxy(ep.url)
+		var chains [][]*url.URL
+		if err == nil {
+			s.add("result", "%s", result)
+			chains, err = proxy.ParsePACResult(result)
+		}
+		if !c.pass(s, err) {
+			return c
+		}
+		chain = chains[0]
+	}
+
+	firstHop := ep.url.Hostname()
+	if len(chain) > 0 {
+		firstHop = chain[0].Hostname()
+	}
+	s := c.step("dns", firstHop)
+	addrs, err := net.LookupHost(firstHop)
+	for _, a := range addrs {
+		s.add("address", "%s", a)
+	}
+	if !c.pass(s, err) {
+		return c
+	}
+
+	conn, ok := cl.checkChain(c, ep, chain)
+	if !ok {
+		return c
+	}
+	defer conn.Close()
+
+	conntls, ok := cl.checkTLS(c, ep, conn)
+	if !ok {
+		return c
+	}
+	cl.checkWebSocket(c, ep, conntls)
+	return c
+}
+
+// checkChain dials through the proxy chain one more hop at a time and returns the connection to the server.
+func (cl *Client) checkChain(c *EndpointCheck, ep *Endpoint, chain []*url.URL) (net.Conn, bool) {
+	if len(chain) == 0 {
+		s := c.step("tcp", ep.url.Host)
+		conn, err := net.Dial("tcp", ep.url.Host)
+		if err == nil {
+			s.add("local", "%s", conn.LocalAddr())
+			s.add("remote", "%s", conn.RemoteAddr())
+		}
+		return conn, c.pass(s, err)
+	}
+
+	var s *CheckStep
+	var host string
+	pc := cl.cfg.Proxy
+	pc.ConnectTrace = func(h string, resp *http.Response) {
+		if h != host {
+			return
+		}
+		s.add("connect", "%s", resp.Status)
+		for _, k := range sortedKeys(resp.Header) {
+			for _, v := range resp.Header[k] {
+				s.add("header", "%s: %s", k, v)
+			}
+		}
+	}
+	var dialer xproxy.Dialer = xproxy.Direct
+	for i, u := range chain {
+		target := ep.url.Host
+		if i+1 < len(chain) {
+			target = proxy.HostPort(chain[i+1])
+		}
+		s = c.step("proxy", fmt.Sprintf("%s -> %s", u.Redacted(), target))
+		host = proxy.HostPort(u)
+		var err error
+		if dialer, err = pc.FromURL(u, dialer); err != nil {
+			c.pass(s, err)
+			return nil, false
+		}
+		conn, err := dialer.Dial("tcp", target)
+		if !c.pass(s, err) {
+			return nil, false
+		}
+		if i+1 == len(chain) {
+			return conn, true
+		}
+		conn.Close()
+	}
+	return nil, false
+}
+
+// checkTLS runs the handshake as the client does, but always collects the certificate chain
+// and verifies it separately to report the verification error.
+func (cl *Client) checkTLS(c *EndpointCheck, ep *Endpoint, conn net.Conn) (*tls.UConn, bool) {
+	s := c.step("tls", ep.url.Hostname())
+	cfg := cl.newServerTLSConfig(ep)
+	var verifyErr error
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			s.add(fmt.Sprintf("cert[%d]", i), "subject=%q issuer=%q not-after=%s pin=%s%s",
+				cert.Subject, cert.Issuer, cert.NotAfter.Format("2006-01-02"),
+				tlsutil.PinPrefix, base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		verifyErr = verifyServerCert(ep, rawCerts)
+		if ep.TLSSkipVerify && len(ep.pins) == 0 {
+			return nil
+		}
+		return verifyErr
+	}
+
+	conntls, err := handshakeTLS(conn, cfg)
+	if err == nil {
+		state := conntls.ConnectionState()
+		s.add("version", "%s", tlsVersionName(state.Version))
+		s.add("cipher", "%s", tls.CipherSuiteName(state.CipherSuite))
+		if state.NegotiatedProtocol != "" {
+			s.add("alpn", "%s", state.NegotiatedProtocol)
+		}
+	}
+	switch {
+	case verifyErr == nil:
+		s.add("verification", "ok")
+	case ep.TLSSkipVerify && len(ep.pins) == 0:
+		s.add("verification", "skipped, would fail: %s", verifyErr)
+	default:
+		s.add("verification", "failed: %s", verifyErr)
+	}
+	return conntls, c.pass(s, err)
+}
+
+// verifyServerCert verifies the server certificate chain as the client does, with the pins if any.
+func verifyServerCert(ep *Endpoint, rawCerts [][]byte) error {
+	return tlsutil.VerifyChain(rawCerts, ep.certPool, ep.url.Hostname(), ep.pins)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// recordingConn keeps a copy of the data read, to parse the WebSocket upgrade response.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+// checkWebSocket runs the WebSocket upgrade and reports the response and the authentication result.
+func (cl *Client) checkWebSocket(c *EndpointCheck, ep *Endpoint, conn net.Conn) {
+	s := c.step("websocket", ep.url.RequestURI())
+	rec := &recordingConn{Conn: conn}
+	wsconn, err := websocket.NewClient(cl.newWebSocketConfig(ep), rec)
+	if wsconn != nil {
+		defer wsconn.Close()
+	}
+
+	status := 0
+	resp, respErr := http.ReadResponse(bufio.NewReader(&rec.buf), nil)
+	if respErr == nil {
+		resp.Body.Close()
+		status = resp.StatusCode
+		s.add("status", "%s", resp.Status)
+		for _, k := range sortedKeys(resp.Header) {
+			for _, v := range resp.Header[k] {
+				s.add("header", "%s: %s", k, v)
+			}
+		}
+	}
+	c.pass(s, err)
+
+	auth := c.step("auth", "password")
+	switch status {
+	case http.StatusSwitchingProtocols:
+		auth.add("result", "accepted")
+		c.pass(auth, nil)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		c.pass(auth, errors.New("rejected by the server"))
+	case 0:
+		c.pass(auth, errors.New("no response from the server"))
+	default:
+		c.pass(auth, fmt.Errorf("unknown, the server answered %d", status))
+	}
+}
+
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
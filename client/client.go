@@ -0,0 +1,424 @@
+// Package client implements the agent, which connects to the server and acts as the exit node of the tunnel.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/internal/socks"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"github.com/metala/revwebsocks5/metrics"
+	"github.com/metala/revwebsocks5/proxy"
+	"github.com/metala/revwebsocks5/spy"
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/websocket"
+)
+
+// Config configures the client. The zero values of UserAgent, ReconnectDelay, ReconnectMaxDelay,
+// ReconnectReset and ShutdownTimeout get the defaults of the command line.
+type Config struct {
+	// Endpoints are the servers to connect to in order of priority.
+	Endpoints            []*Endpoint
+	Password             string
+	UserAgent            string
+	ProxyFromEnvironment bool
+	Proxy                proxy.Config
+	KeyLogWriter         io.Writer
+
+	FailbackInterval  time.Duration // between checks of the preferred endpoint, 0 to disable
+	ReconnectLimit    int           // consecutive failed reconnections, 0 for unlimited
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+	ReconnectReset    time.Duration // of healthy session resetting the reconnection backoff
+	AuthFailureLimit  int           // consecutive rejected authentications, 0 for unlimited
+
+	// Dial and Resolver are the egress of the tunnelled connections, the system ones if nil.
+	// The DNS queries of the server are forwarded as is through the Dial of the Resolver, if set.
+	Dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	Resolver *net.Resolver
+
+	Audit   *audit.Log
+	Capture *spy.Capture
+	Tracer  *spy.Tracer
+	Metrics *metrics.Registry // of the client only if nil
+
+	ShutdownTimeout time.Duration
+	Logger          *slog.Logger
+}
+
+// Client keeps the tunnel to the server endpoints and serves the tunnelled SOCKS5 connections and DNS queries.
+type Client struct {
+	cfg         Config
+	log         *slog.Logger
+	socksConfig *socks5.Config
+
+	// current is the index of the endpoint connected to, and pending the session established
+	// with the preferred endpoint on fail back.
+	current int
+	pending *yamux.Session
+}
+
+// New returns the client of the configuration, with its endpoints loaded.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("no server endpoints")
+	}
+	if cfg.ReconnectDelay < 0 || cfg.ReconnectMaxDelay < 0 || cfg.ReconnectReset < 0 {
+		return nil, errors.New("negative reconnection delay")
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "curl/8.1.2"
+	}
+	if cfg.ReconnectDelay == 0 {
+		cfg.ReconnectDelay = 5 * time.Second
+	}
+	if cfg.ReconnectMaxDelay == 0 {
+		cfg.ReconnectMaxDelay = 300 * time.Second
+	}
+	if cfg.ReconnectReset == 0 {
+		cfg.ReconnectReset = 60 * time.Second
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewRegistry()
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = (&net.Dialer{}).DialContext
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	if cfg.Proxy.UserAgent == "" {
+		cfg.Proxy.UserAgent = cfg.UserAgent
+	}
+	if cfg.Proxy.KeyLogWriter == nil {
+		cfg.Proxy.KeyLogWriter = cfg.KeyLogWriter
+	}
+	if cfg.Proxy.Tracer == nil {
+		cfg.Proxy.Tracer = cfg.Tracer
+	}
+	c := &Client{
+		cfg: cfg,
+		log: cfg.Logger,
+		socksConfig: &socks5.Config{
+			Resolver: socksResolver{cfg.Resolver},
+			Dial:     cfg.Dial,
+			Logger:   slog.NewLogLogger(cfg.Logger.Handler(), slog.LevelDebug),
+		},
+	}
+	for _, ep := range cfg.Endpoints {
+		if err := c.initEndpoint(ep); err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", ep, err)
+		}
+	}
+	return c, nil
+}
+
+// dialSession connects to the server endpoint and establishes the tunnel session.
+func (c *Client) dialSession(ep *Endpoint) (*yamux.Session, error) {
+	c.log.Debug("Dialling", "endpoint", ep.String())
+	conn, err := c.dial(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	c.log.Debug("Establishing TLS connection", "endpoint", ep.String())
+	conntls, err := handshakeTLS(conn, c.newServerTLSConfig(ep))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn = c.cfg.Capture.Conn(conntls, "endpoint="+ep.String())
+	conn = c.cfg.Tracer.Decode(conn, "conn")
+	sc := &statusConn{Conn: conn}
+
+	c.log.Debug("Starting tunnel client", "endpoint", ep.String())
+	wsconn, err := websocket.NewClient(c.newWebSocketConfig(ep), sc)
+	if err != nil {
+		sc.Close()
+		if errors.Is(err, websocket.ErrBadStatus) && sc.statusCode() != 0 {
+			return nil, &statusError{sc.statusCode()}
+		}
+		return nil, err
+	}
+	c.log.Debug("Starting tunnel session", "endpoint", ep.String())
+	mux := c.cfg.Capture.Mux(wsconn, conntls.LocalAddr().String(), conntls.RemoteAddr().String(), "endpoint="+ep.String())
+	session, err := yamux.Server(mux, nil)
+	if err != nil {
+		wsconn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// statusConn keeps the status line of the WebSocket upgrade response, which the websocket package doesn't return.
+type statusConn struct {
+	net.Conn
+	line []byte
+	done bool
+}
+
+func (c *statusConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done {
+		if i := bytes.IndexByte(p[:n], '\n'); i >= 0 {
+			c.line = append(c.line, p[:i]...)
+			c.done = true
+		} else if c.line = append(c.line, p[:n]...); len(c.line) > 256 {
+			c.done = true
+		}
+	}
+	return n, err
+}
+
+// statusCode returns the status code of the response, 0 if unknown.
+func (c *statusConn) statusCode() int {
+	fields := strings.Fields(string(c.line))
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// newServerTLSConfig returns the TLS configuration verifying the server endpoint. It offers only HTTP/1.1,
+// as the WebSocket upgrade fails on a server choosing HTTP/2.
+func (c *Client) newServerTLSConfig(ep *Endpoint) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         tls.VersionTLS13,
+		RootCAs:            ep.certPool,
+		InsecureSkipVerify: ep.TLSSkipVerify || len(ep.pins) > 0,
+		ServerName:         ep.url.Hostname(),
+		NextProtos:         []string{"http/1.1"},
+		KeyLogWriter:       c.cfg.KeyLogWriter,
+	}
+	if len(ep.pins) > 0 {
+		cfg.VerifyPeerCertificate = ep.pins.Verifier(ep.certPool, cfg.ServerName)
+	}
+	return cfg
+}
+
+// handshakeTLS runs the TLS handshake with a browser-like ClientHello.
+func handshakeTLS(conn net.Conn, cfg *tls.Config) (*tls.UConn, error) {
+	conntls := tls.UClient(conn, cfg, tls.HelloCustom)
+	conntls.ApplyPreset(&tls.ClientHelloSpec{
+		TLSVersMin: tls.VersionTLS12,
+		TLSVersMax: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			0x1302, 0x1303, 0x1301, 0xc02c, 0xc030, 0x009f, 0xcca9, 0xcca8,
+			0xccaa, 0xc02b, 0xc02f, 0x009e, 0xc024, 0xc028, 0x006b, 0xc023,
+			0xc027, 0x0067, 0xc014, 0x0039, 0xc009, 0xc013, 0x0033, 0x009d,
+			0x009d, 0x009c, 0x003d, 0x003c, 0x0035, 0x002f, 0x00ff,
+		},
+		CompressionMethods: []uint8{0},
+		Extensions: []tls.TLSExtension{
+			&tls.SNIExtension{ServerName: cfg.ServerName},
+			&tls.SupportedPointsExtension{SupportedPoints: []uint8{0, 1, 2}},
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{
+				/* x25519 */ 0x001d /* secp256r1 */, 0x0017 /* x448 */, 0x001e /*secp521r1*/, 0x0019,
+				0x0018, 0x0100, 0x0101, 0x0102, 0x0103, 0x0104,
+			}},
+			&tls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}},
+			&tls.GenericExtension{Id: 22},
+			&tls.UtlsExtendedMasterSecretExtension{},
+			&tls.GenericExtension{Id: 49},
+			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
+				0x0403, 0x0503, 0x0603, 0x0807, 0x0808, 0x0809, 0x080a, 0x080b,
+				0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0303, 0x0301,
+				0x0302, 0x0402, 0x0502, 0x0602,
+			}},
+			&tls.SupportedVersionsExtension{Versions: []uint16{
+				tls.VersionTLS13, tls.VersionTLS12,
+			}},
+			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{
+				tls.PskModeDHE,
+			}},
+			&tls.KeyShareExtension{
+				KeyShares: []tls.KeyShare{
+					{Group: tls.X25519},
+				},
+			},
+			&tls.UtlsPaddingExtension{PaddingLen: 174, WillPad: true},
+		},
+	})
+	if err := conntls.Handshake(); err != nil {
+		return nil, err
+	}
+	return conntls, nil
+}
+
+// newWebSocketConfig returns the WebSocket configuration authenticating to the server endpoint.
+func (c *Client) newWebSocketConfig(ep *Endpoint) *websocket.Config {
+	return &websocket.Config{
+		Location: ep.url,
+		Origin:   ep.url,
+		Version:  13,
+		Header: http.Header{
+			"User-Agent":    []string{c.cfg.UserAgent},
+			"Authorization": []string{c.cfg.Password},
+			"Connection":    []string{"Upgrade"},
+		},
+	}
+}
+
+// serveSession serves the tunnelled SOCKS5 connections and DNS queries until the session ends.
+// On ctx done, it stops accepting streams and drains the connections before closing the session.
+func (c *Client) serveSession(ctx context.Context, session *yamux.Session) error {
+	var streams sync.WaitGroup
+	var goodbye int32
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-session.CloseChan():
+			return
+		}
+		c.log.Info("Shutting down, draining connections")
+		session.GoAway()
+		if !tunnel.WaitTimeout(&streams, c.cfg.ShutdownTimeout) {
+			c.log.Warn("Timed out draining connections")
+		}
+		session.Close()
+	}()
+
+	c.log.Info("Accepting connections to SOCKS5 server")
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if atomic.LoadInt32(&goodbye) != 0 {
+				return tunnel.ErrGoodbye
+			}
+			return err
+		}
+		streams.Add(1)
+		c.cfg.Metrics.Streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer c.cfg.Metrics.Streams.Add(-1)
+			var s net.Conn = stream
+			if c.cfg.Tracer.Streams() {
+				s = c.cfg.Tracer.Conn(stream, fmt.Sprintf("stream %d", stream.StreamID()))
+			}
+			conn := tunnel.NewBufferedConn(s)
+			t, err := conn.StreamType()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			switch t {
+			case tunnel.StreamGoodbye:
+				c.log.Info("Got goodbye from the server")
+				atomic.StoreInt32(&goodbye, 1)
+				conn.Close()
+			case tunnel.StreamSocks5:
+				c.serveSocksStream(stream.StreamID(), conn)
+			case tunnel.StreamDNS:
+				c.serveDNSStream(ctx, conn)
+			case tunnel.StreamConnect, tunnel.StreamResolve:
+				c.serveConnectStream(ctx, stream.StreamID(), conn)
+			default:
+				c.log.Warn("Unknown stream type", "stream_id", stream.StreamID(), "type", fmt.Sprintf("0x%02x", t))
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// serveSocksStream serves the SOCKS5 connection of the stream, then logs and audits its destination and traffic.
+func (c *Client) serveSocksStream(id uint32, conn net.Conn) {
+	logger := c.log.With("stream_id", id)
+	logger.Debug("Serving new SOCKS5 connection")
+	conf := *c.socksConfig
+	resolver := &recordingResolver{NameResolver: c.socksConfig.Resolver}
+	conf.Resolver = resolver
+	socksHandler, err := socks5.New(&conf)
+	if err != nil {
+		logger.Error("Error creating the SOCKS5 server", "err", err)
+		conn.Close()
+		return
+	}
+
+	tapped := &socksTapConn{countingConn: countingConn{Conn: conn}}
+	started := time.Now()
+	err = socksHandler.ServeConn(tapped)
+	duration := time.Since(started)
+	c.cfg.Metrics.StreamDuration.Observe(duration.Seconds())
+
+	rec := &audit.Record{
+		Time:          started,
+		StreamID:      id,
+		Result:        socksResult(tapped.reply()),
+		BytesSent:     atomic.LoadInt64(&tapped.read),
+		BytesReceived: atomic.LoadInt64(&tapped.written),
+		Duration:      duration.Seconds(),
+	}
+	if reply := tapped.reply(); reply != nil {
+		rec.BytesReceived -= int64(2 + len(reply.Bytes()))
+	}
+	if req := tapped.request(); req != nil {
+		rec.BytesSent -= int64(2 + int(tapped.in[1]) + len(req.Bytes()))
+		rec.Dst = req.String()
+		if !req.IsDomain() {
+			rec.ResolvedIP = req.Host
+		} else if resolver.ip != nil {
+			rec.ResolvedIP = resolver.ip.String()
+		}
+		logger = logger.With("dst", rec.Dst)
+		c.writeAudit(rec)
+	}
+	if err != nil {
+		c.cfg.Metrics.SocksConns.Add(1, "failed")
+		logger.Warn("SOCKS5 connection failed", "err", err, "duration", duration)
+		return
+	}
+	c.cfg.Metrics.SocksConns.Add(1, "accepted")
+	logger.Info("SOCKS5 connection closed",
+		"bytes_in", rec.BytesSent, "bytes_out", rec.BytesReceived, "duration", duration)
+}
+
+// writeAudit writes the record to the audit log, if any.
+func (c *Client) writeAudit(rec *audit.Record) {
+	if err := c.cfg.Audit.Write(rec); err != nil {
+		c.log.Error("Failed to write the audit log", "err", err)
+	}
+}
+
+// ServeSocks serves SOCKS5 clients local to the client on ln, independently of the tunnel,
+// with the same egress and resolver.
+func (c *Client) ServeSocks(ln net.Listener) error {
+	socksHandler, err := socks5.New(c.socksConfig)
+	if err != nil {
+		return err
+	}
+	return socksHandler.Serve(ln)
+}
+
+// socksResult returns the audit result of the SOCKS5 reply.
+func socksResult(reply *socks.Request) string {
+	if reply == nil {
+		return "no-reply"
+	}
+	return socks.ReplyName(reply.Cmd)
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/internal/socks"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+// serveConnectStream connects to the destination of the connect stream through the egress of the SOCKS5 server,
+// then relays the stream to it and logs and audits it. On a resolve stream, it reports the resolved address
+// and waits for the server to approve it before connecting.
+func (c *Client) serveConnectStream(ctx context.Context, id uint32, conn *tunnel.BufferedConn) {
+	defer conn.Close()
+	logger := c.log.With("stream_id", id)
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	req, err := socks.ReadAddr(conn, socks.Connect, hdr[1])
+	if err != nil {
+		logger.Warn("Invalid connect stream", "err", err)
+		return
+	}
+	logger = logger.With("dst", req.String())
+
+	started := time.Now()
+	rec := &audit.Record{Time: started, StreamID: id, Dst: req.String()}
+	defer func() {
+		rec.Duration = time.Since(started).Seconds()
+		c.writeAudit(rec)
+		c.cfg.Metrics.StreamDuration.Observe(rec.Duration)
+	}()
+	ip := net.ParseIP(req.Host)
+	if ip == nil {
+		if _, ip, err = c.socksConfig.Resolver.Resolve(ctx, req.Host); err != nil {
+			c.connectFailed(conn, rec, socks.HostUnreachable)
+			logger.Warn("Failed to resolve the destination", "err", err)
+			return
+		}
+	}
+	rec.ResolvedIP = ip.String()
+	if hdr[0] == tunnel.StreamResolve {
+		resolved := &socks.Request{Host: ip.String(), Port: req.Port}
+		var verdict [1]byte
+		if _, err := conn.Write(append([]byte{socks.Succeeded}, resolved.AddrBytes()...)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, verdict[:]); err != nil {
+			return
+		}
+		if verdict[0] != socks.Succeeded {
+			rec.Result = socks.ReplyName(verdict[0])
+			c.cfg.Metrics.SocksConns.Add(1, "failed")
+			logger.Warn("The server denied the resolved destination", "resolved_ip", rec.ResolvedIP)
+			return
+		}
+	}
+	target, err := c.socksConfig.Dial(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(req.Port))))
+	if err != nil {
+		c.connectFailed(conn, rec, connectErrorCode(err))
+		logger.Warn("Failed to connect to the destination", "err", err)
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{socks.Succeeded}); err != nil {
+		return
+	}
+	rec.Result = socks.ReplyName(socks.Succeeded)
+	c.cfg.Metrics.SocksConns.Add(1, "accepted")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		rec.BytesSent, _ = io.Copy(target, conn)
+		target.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		rec.BytesReceived, _ = io.Copy(conn, target)
+		conn.Close()
+	}()
+	wg.Wait()
+	logger.Info("Connection closed",
+		"bytes_in", rec.BytesSent, "bytes_out", rec.BytesReceived, "duration", time.Since(started))
+}
+
+func (c *Client) connectFailed(conn net.Conn, rec *audit.Record, code byte) {
+	conn.Write([]byte{code})
+	rec.Result = socks.ReplyName(code)
+	c.cfg.Metrics.SocksConns.Add(1, "failed")
+}
+
+// connectErrorCode returns the SOCKS5 reply code of the dial error, like the SOCKS5 server does.
+func connectErrorCode(err error) byte {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return socks.ConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return socks.NetworkUnreachable
+	}
+	return socks.HostUnreachable
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout = 10 * time.Second
+	dnsTTL     = 60
+)
+
+// serveDNSStream answers the DNS queries of the server with the resolver of the agent.
+func (c *Client) serveDNSStream(ctx context.Context, conn *tunnel.BufferedConn) {
+	defer conn.Close()
+	if _, err := conn.Reader.Discard(1); err != nil {
+		return
+	}
+	for {
+		query, err := tunnel.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		answer, err := c.answerDNS(lookupCtx, query)
+		cancel()
+		if err != nil {
+			c.log.Warn("Error answering DNS query", "err", err)
+			return
+		}
+		if err := tunnel.WriteDNSMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// answerDNS forwards the query as is to the DNS server of the resolver, if it has one, as NewResolver returns.
+// Otherwise it answers the query with the lookups of the resolver, which also go through the hosts file.
+// Only the common record types are supported then.
+func (c *Client) answerDNS(ctx context.Context, query []byte) ([]byte, error) {
+	if c.cfg.Resolver.Dial != nil {
+		conn, err := c.cfg.Resolver.Dial(ctx, "udp", "")
+		if err == nil {
+			return forwardDNS(ctx, conn, query)
+		}
+		c.log.Debug("Failed to dial the DNS server, answering with the lookups", "err", err)
+	}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			OpCode:             hdr.OpCode,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	c.log.Debug("Resolving DNS", "type", q.Type.String(), "name", q.Name.String())
+	msg.Answers, msg.RCode = lookupDNS(ctx, c.cfg.Resolver, q)
+	return msg.Pack()
+}
+
+// forwardDNS exchanges the query with the DNS server, over the datagrams of a packet connection
+// or the length prefixed messages of a stream connection.
+func forwardDNS(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, ok := conn.(net.PacketConn); !ok {
+		if err := tunnel.WriteDNSMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return tunnel.ReadDNSMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the stray answers to other queries.
+		if n >= 2 && len(query) >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func lookupDNS(ctx context.Context, resolver *net.Resolver, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode) {
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	var bodies []dnsmessage.ResourceBody
+	var err error
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		network := "ip4"
+		if q.Type == dnsmessage.TypeAAAA {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				bodies = append(bodies, &a)
+			} else {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip.To16())
+				bodies = append(bodies, &aaaa)
+			}
+		}
+	case dnsmessage.TypeCNAME:
+		var cname string
+		if cname, err = resolver.LookupCNAME(ctx, name); err == nil && !strings.EqualFold(cname, name+".") {
+			bodies = append(bodies, &dnsmessage.CNAMEResource{CNAME: dnsName(cname)})
+		}
+	case dnsmessage.TypePTR:
+		var names []string
+		if names, err = resolver.LookupAddr(ctx, reverseAddr(name)); err == nil {
+			for _, n := range names {
+				bodies = append(bodies, &dnsmessage.PTRResource{PTR: dnsName(n)})
+			}
+		}
+	case dnsmessage.TypeMX:
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			bodies = append(bodies, &dnsmessage.MXResource{Pref: mx.Pref, MX: dnsName(mx.Host)})
+		}
+	case dnsmessage.TypeNS:
+		var nss []*net.NS
+		nss, err = resolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			bodies = append(bodies, &dnsmessage.NSResource{NS: dnsName(ns.Host)})
+		}
+	case dnsmessage.TypeTXT:
+		var txts []string
+		txts, err = resolver.LookupTXT(ctx, name)
+		for _, txt := range txts {
+			bodies = append(bodies, &dnsmessage.TXTResource{TXT: splitTXT(txt)})
+		}
+	case dnsmessage.TypeSRV:
+		var srvs []*net.SRV
+		_, srvs, err = resolver.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			bodies = append(bodies, &dnsmessage.SRVResource{
+				Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dnsName(srv.Target),
+			})
+		}
+	default:
+		return nil, dnsmessage.RCodeNotImplemented
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		// The lookups fail alike for the names without records of the type, like the IPv4 only names
+		// queried for AAAA records. The names with addresses get an empty answer rather than NXDOMAIN.
+		if _, err := resolver.LookupIPAddr(ctx, name); err == nil {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		return nil, dnsmessage.RCodeNameError
+	case err != nil:
+		return nil, dnsmessage.RCodeServerFailure
+	}
+	answers := make([]dnsmessage.Resource, len(bodies))
+	for i, body := range bodies {
+		answers[i] = dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+			Body:   body,
+		}
+	}
+	return answers, dnsmessage.RCodeSuccess
+}
+
+// dnsName returns the absolute DNS name, ignoring the invalid ones as the message packing fails with them.
+func dnsName(name string) dnsmessage.Name {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, _ := dnsmessage.NewName(name)
+	return n
+}
+
+// splitTXT splits the TXT record into the 255 bytes character strings.
+func splitTXT(txt string) []string {
+	var parts []string
+	for len(txt) > 255 {
+		parts = append(parts, txt[:255])
+		txt = txt[255:]
+	}
+	return append(parts, txt)
+}
+
+// reverseAddr returns the IP address of the in-addr.arpa or ip6.arpa name, or the name itself.
+func reverseAddr(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) == net.IPv4len {
+			for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+				labels[i], labels[j] = labels[j], labels[i]
+			}
+			return strings.Join(labels, ".")
+		}
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) == 2*net.IPv6len {
+			var b strings.Builder
+			for i := len(nibbles) - 1; i >= 0; i-- {
+				b.WriteString(nibbles[i])
+				if i%4 == 0 && i > 0 {
+					b.WriteByte(':')
+				}
+			}
+			return b.String()
+		}
+	}
+	return name
+}
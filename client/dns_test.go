@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveFakeDNS serves v4only.test. with an A record and no AAAA record, and NXDOMAIN for the other names.
+// The answers have a TTL of 300.
+func serveFakeDNS(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Response, msg.RecursionAvailable = true, true
+			switch {
+			case q.Name.String() != "v4only.test.":
+				msg.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeA:
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}}
+			}
+			answer, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(answer, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func query(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// dnsTests are the queries to the fake DNS server, with the expected reply code and answer count.
+var dnsTests = []struct {
+	name    string
+	qname   string
+	qtype   dnsmessage.Type
+	rcode   dnsmessage.RCode
+	answers int
+}{
+	{"A", "v4only.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1},
+	{"AAAA of an IPv4 only name", "v4only.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0},
+	{"missing name", "missing.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0},
+}
+
+func checkAnswer(t *testing.T, answer []byte, rcode dnsmessage.RCode, answers int, ttl uint32) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 42 || msg.RCode != rcode || len(msg.Answers) != answers {
+		t.Fatalf("answer ID %d, %s with %d answers, want ID 42, %s with %d answers",
+			msg.ID, msg.RCode, len(msg.Answers), rcode, answers)
+	}
+	for _, rr := range msg.Answers {
+		if rr.Header.TTL != ttl {
+			t.Errorf("TTL %d, want %d", rr.Header.TTL, ttl)
+		}
+	}
+}
+
+// TestAnswerDNSLookup answers with the lookups of a resolver without Dial, as the system resolver.
+func TestAnswerDNSLookup(t *testing.T) {
+	addr := serveFakeDNS(t)
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	for _, tt := range dnsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p dnsmessage.Parser
+			hdr, err := p.Start(query(t, tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := p.Question()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := dnsmessage.Message{Header: dnsmessage.Header{ID: hdr.ID, Response: true}, Questions: []dnsmessage.Question{q}}
+			msg.Answers, msg.RCode = lookupDNS(context.Background(), resolver, q)
+			answer, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, answer, tt.rcode, tt.answers, dnsTTL)
+		})
+	}
+}
+
+// TestAnswerDNSForward forwards the queries to the DNS server of the resolver, keeping its TTLs.
+func TestAnswerDNSForward(t *testing.T) {
+	addr := serveFakeDNS(t)
+	resolver, err := NewResolver("udp://"+addr, (&net.Dialer{}).DialContext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{cfg: Config{Resolver: resolver}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	for _, tt := range dnsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, err := c.answerDNS(context.Background(), query(t, tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, answer, tt.rcode, tt.answers, 300)
+		})
+	}
+}
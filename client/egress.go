@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Egress dials the outbound connections of the SOCKS server from a source address or interface.
+type Egress struct {
+	ip    net.IP
+	iface string
+}
+
+// NewEgress returns the egress from the source address and the interface, if not empty.
+// Binding to an interface is only supported on Linux.
+func NewEgress(bind, iface string) (*Egress, error) {
+	d := &Egress{iface: iface}
+	if bind != "" {
+		if d.ip = net.ParseIP(bind); d.ip == nil {
+			return nil, fmt.Errorf("invalid egress bind address '%s'", bind)
+		}
+	}
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("egress interface '%s': %w", iface, err)
+		}
+		if err := checkBindToDevice(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Egress) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if d.ip != nil {
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			dialer.LocalAddr = &net.TCPAddr{IP: d.ip}
+		case strings.HasPrefix(network, "udp"):
+			dialer.LocalAddr = &net.UDPAddr{IP: d.ip}
+		}
+	}
+	if d.iface != "" {
+		dialer.Control = bindToDevice(d.iface)
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// NewResolver returns the resolver for the DNS server address, reached through dial.
+// The address is a DNS server as ip[:port], udp:// or tcp://, a DNS over TLS server as tls://host[:port],
+// or a DNS over HTTPS URL as https://host/path. An empty address is the system resolver.
+// The DNS over TLS secrets are logged to keyLog, if not nil.
+func NewResolver(address string, dial func(ctx context.Context, network, addr string) (net.Conn, error), keyLog io.Writer) (*net.Resolver, error) {
+	if address == "" {
+		return net.DefaultResolver, nil
+	}
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver '%s': %w", address, err)
+	}
+	host := u.Host
+	withPort := func(port string) {
+		if u.Port() == "" {
+			host = net.JoinHostPort(strings.Trim(u.Host, "[]"), port)
+		}
+	}
+
+	var dialDNS func(ctx context.Context, network, address string) (net.Conn, error)
+	switch u.Scheme {
+	case "udp", "tcp":
+		withPort("53")
+		dialDNS = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, u.Scheme, host)
+		}
+	case "tls":
+		withPort("853")
+		cfg := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12, KeyLogWriter: keyLog}
+		dialDNS = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := dial(ctx, "tcp", host)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, cfg), nil
+		}
+	case "https":
+		client := &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:       nil,
+				DialContext: dial,
+			},
+		}
+		dialDNS = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, url: u.String()}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported resolver '%s'", address)
+	}
+	return &net.Resolver{PreferGo: true, Dial: dialDNS}, nil
+}
+
+// dohConn carries the DNS over TCP messages of the Go resolver as DNS over HTTPS requests (RFC 8484).
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	query  bytes.Buffer
+	answer bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.query.Write(p)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		c.query.Next(2)
+		if err := c.roundTrip(c.query.Next(size)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *dohConn) roundTrip(msg []byte) error {
+	req, err := http.NewRequestWithContext(c.ctx, "POST", c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS over HTTPS: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return err
+	}
+	binary.Write(&c.answer, binary.BigEndian, uint16(len(body)))
+	c.answer.Write(body)
+	return nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+// socksResolver resolves the SOCKS5 domain requests with the resolver, preferring IPv4.
+type socksResolver struct {
+	r *net.Resolver
+}
+
+func (s socksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := s.r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return ctx, a.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return ctx, nil, errors.New("no address for " + name)
+	}
+	return ctx, addrs[0].IP, nil
+}
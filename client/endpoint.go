@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/internal/tlsutil"
+	"github.com/metala/revwebsocks5/proxy"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// errFailback is returned when the client leaves a session for the preferred endpoint.
+var errFailback = errors.New("failing back to the preferred endpoint")
+
+// Endpoint is a server the client connects to, with its own TLS verification and proxy chain.
+type Endpoint struct {
+	URL           string   `json:"url"`
+	Proxies       []string `json:"proxy"`
+	ProxyPAC      string   `json:"proxy-pac"`
+	TLSCert       string   `json:"tls-cert"`
+	TLSPins       []string `json:"tls-pin"`
+	TLSSkipVerify bool     `json:"tls-skip-verify"`
+
+	url       *url.URL
+	proxyURLs []*url.URL
+	pac       *proxy.PAC
+	certPool  *x509.CertPool
+	pins      tlsutil.Pinset
+}
+
+func (ep *Endpoint) String() string {
+	return ep.URL
+}
+
+// LoadEndpoints reads the endpoints in priority order from the JSON file.
+func LoadEndpoints(filename string) ([]*Endpoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	return endpoints, nil
+}
+
+// initEndpoint parses and loads the endpoint settings.
+func (c *Client) initEndpoint(ep *Endpoint) error {
+	var err error
+	if ep.url, err = url.Parse(ep.URL); err != nil {
+		return err
+	}
+	for _, pu := range ep.Proxies {
+		u, err := url.Parse(pu)
+		if err != nil {
+			return fmt.Errorf("invalid proxy '%s': %w", pu, err)
+		}
+		ep.proxyURLs = append(ep.proxyURLs, u)
+	}
+	if len(ep.proxyURLs) == 0 && ep.ProxyPAC != "" {
+		if ep.pac, err = proxy.LoadPAC(ep.ProxyPAC); err != nil {
+			return err
+		}
+	}
+	if len(ep.proxyURLs) == 0 && ep.pac == nil && c.cfg.ProxyFromEnvironment {
+		u, err := proxy.FromEnvironment(ep.url)
+		if err != nil {
+			return fmt.Errorf("proxy from environment: %w", err)
+		}
+		if u != nil {
+			c.log.Info("Using proxy from environment", "proxy", u.Redacted(), "endpoint", ep.String())
+			ep.proxyURLs = append(ep.proxyURLs, u)
+		}
+	}
+	if ep.certPool, err = tlsutil.LoadCertPool(ep.TLSCert); err != nil {
+		return err
+	}
+	if ep.pins, err = tlsutil.ParsePins(ep.TLSPins); err != nil {
+		return err
+	}
+	return nil
+}
+
+// dial connects to the server host of the endpoint through the proxy chain, or through the PAC alternatives in order.
+func (c *Client) dial(ep *Endpoint) (net.Conn, error) {
+	chains := [][]*url.URL{ep.proxyURLs}
+	if ep.pac != nil {
+		var err error
+		if chains, err = ep.pac.ProxyChains(ep.url); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	for _, chain := range chains {
+		var conn net.Conn
+		if conn, err = c.dialChain(chain, ep.url.Host); err == nil {
+			if len(chain) == 0 {
+				conn = c.cfg.Tracer.Conn(conn, "conn raw")
+			}
+			return conn, nil
+		}
+		if len(chains) > 1 {
+			c.log.Warn("Failed to dial", "endpoint", ep.String(), "proxy", proxy.ChainString(chain), "err", err)
+		}
+	}
+	return nil, err
+}
+
+// dialChain connects to the address through the proxies of the chain in order.
+func (c *Client) dialChain(chain []*url.URL, addr string) (net.Conn, error) {
+	var dialer xproxy.Dialer = xproxy.Direct
+	for _, u := range chain {
+		var err error
+		if dialer, err = c.cfg.Proxy.FromURL(u, dialer); err != nil {
+			return nil, err
+		}
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// connect tries the endpoints, starting with the current one, and serves the first established session.
+// It fails over to the next endpoint, and while connected to a less preferred endpoint,
+// it periodically checks if the preferred one is back.
+func (c *Client) connect(ctx context.Context) error {
+	if c.pending != nil {
+		session := c.pending
+		c.pending = nil
+		return c.serve(ctx, session)
+	}
+
+	endpoints := c.cfg.Endpoints
+	var err error
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[c.current]
+		c.log.Info("Connecting", "endpoint", ep.String())
+		var session *yamux.Session
+		session, err = c.dialSession(ep)
+		if err == nil {
+			return c.serve(ctx, session)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if len(endpoints) > 1 {
+			c.log.Warn("Failed to connect", "endpoint", ep.String(), "class", classifyFailure(err), "err", err)
+		}
+		c.current = (c.current + 1) % len(endpoints)
+	}
+	return err
+}
+
+// serve serves the session until it ends or the preferred endpoint is back.
+// In the latter case, the session is drained in the background and errFailback is returned.
+func (c *Client) serve(ctx context.Context, session *yamux.Session) error {
+	preferred := c.cfg.Endpoints[0]
+	go c.cfg.Metrics.PingSession(session, c.cfg.Endpoints[c.current].URL)
+	sessionCtx, cancel := context.WithCancel(ctx)
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serveSession(sessionCtx, session)
+	}()
+
+	var failback <-chan time.Time
+	if c.current > 0 && c.cfg.FailbackInterval > 0 {
+		ticker := time.NewTicker(c.cfg.FailbackInterval)
+		defer ticker.Stop()
+		failback = ticker.C
+	}
+	for {
+		select {
+		case err := <-done:
+			cancel()
+			return &sessionError{err: err, duration: time.Since(started)}
+		case <-failback:
+			session, err := c.dialSession(preferred)
+			if err != nil {
+				c.log.Debug("Preferred endpoint is still down", "endpoint", preferred.String(), "err", err)
+				continue
+			}
+			c.log.Info("Preferred endpoint is back, failing back", "endpoint", preferred.String())
+			c.current = 0
+			c.pending = session
+			cancel()
+			return errFailback
+		}
+	}
+}
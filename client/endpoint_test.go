@@ -0,0 +1,49 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDialPACAlternatives skips the PAC alternatives failing to set up, like a proxy without its credentials.
+func TestDialPACAlternatives(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dir := t.TempDir()
+	pacFile := filepath.Join(dir, "proxy.pac")
+	script := `function FindProxyForURL(url, host) { return "PROXY 127.0.0.1:1; DIRECT"; }`
+	if err := os.WriteFile(pacFile, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Endpoints: []*Endpoint{{URL: "https://" + ln.Addr().String(), ProxyPAC: pacFile}},
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	cfg.Proxy.Credentials = filepath.Join(dir, "missing.netrc")
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.dial(cfg.Endpoints[0])
+	if err != nil {
+		t.Fatalf("dial() = %v, want the DIRECT alternative", err)
+	}
+	conn.Close()
+}
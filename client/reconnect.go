@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+// sessionError is returned when an established tunnel session ends.
+type sessionError struct {
+	err      error
+	duration time.Duration
+}
+
+func (e *sessionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sessionError) Unwrap() error {
+	return e.err
+}
+
+// statusError is returned when the server answers the WebSocket upgrade with another status.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", websocket.ErrBadStatus, e.code, http.StatusText(e.code))
+}
+
+func (e *statusError) Unwrap() error {
+	return websocket.ErrBadStatus
+}
+
+// Classes of connection failures.
+const (
+	failureNetwork = "network"
+	failureTLS     = "tls"
+	failureAuth    = "auth"
+	failureSession = "session"
+)
+
+// classifyFailure tells the class of a connection failure. Only the 401 and 403 statuses are auth failures,
+// the others come from the proxies in front of the server, its fallback or its shutdown.
+func classifyFailure(err error) string {
+	var se *sessionError
+	if errors.As(err, &se) {
+		return failureSession
+	}
+	var status *statusError
+	if errors.As(err, &status) && (status.code == http.StatusUnauthorized || status.code == http.StatusForbidden) {
+		return failureAuth
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalidCert) {
+		return failureTLS
+	}
+	return failureNetwork
+}
+
+// backoff computes exponentially growing delays with jitter, capped at the max delay.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+	rand    *rand.Rand
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{
+		base: base,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before the next attempt.
+// The delay is randomized between half and the full exponential delay.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 63 && b.base <= b.max>>b.attempt {
+		d = b.base << b.attempt
+	}
+	b.attempt++
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(b.rand.Int63n(int64(d-half)))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// Run keeps the client connected, reconnecting with backoff, until ctx is done.
+// It returns an error when the reconnection or the authentication failure limit is reached.
+func (c *Client) Run(ctx context.Context) error {
+	b := newBackoff(c.cfg.ReconnectDelay, c.cfg.ReconnectMaxDelay)
+	failures, authFailures := 0, 0
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			c.cfg.Metrics.Reconnects.Add(1)
+		}
+		if c.cfg.ReconnectLimit > 0 {
+			c.log.Info("Connecting to the server", "attempt", failures+1, "limit", c.cfg.ReconnectLimit)
+		} else {
+			c.log.Info("Connecting to the server", "attempt", attempt)
+		}
+		err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var se *sessionError
+		if errors.As(err, &se) && se.duration >= c.cfg.ReconnectReset {
+			c.log.Info("Session ended", "duration", se.duration.Round(time.Second), "err", err)
+			b.reset()
+			failures, authFailures = 0, 0
+			continue
+		}
+		if errors.Is(err, tunnel.ErrGoodbye) {
+			c.log.Info("The server is going away, reconnecting")
+			continue
+		}
+		if errors.Is(err, errFailback) {
+			continue
+		}
+
+		class := classifyFailure(err)
+		c.log.Warn("Failed to connect", "class", class, "err", err)
+		c.cfg.Metrics.ConnectFailures.Add(1, string(class))
+		failures++
+		if class == failureAuth {
+			authFailures++
+		} else {
+			authFailures = 0
+		}
+		if c.cfg.AuthFailureLimit > 0 && authFailures >= c.cfg.AuthFailureLimit {
+			return fmt.Errorf("authentication rejected %d times in a row, giving up", authFailures)
+		}
+		if c.cfg.ReconnectLimit > 0 && failures >= c.cfg.ReconnectLimit {
+			return fmt.Errorf("failed to connect %d times in a row, giving up", failures)
+		}
+
+		delay := b.next()
+		if class == failureAuth {
+			delay = b.max
+		}
+		c.log.Info("Sleeping before reconnecting", "delay", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/testutil"
+
+	"golang.org/x/net/websocket"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&statusError{http.StatusUnauthorized}, failureAuth},
+		{&statusError{http.StatusForbidden}, failureAuth},
+		{fmt.Errorf("endpoint: %w", &statusError{http.StatusForbidden}), failureAuth},
+		{&statusError{http.StatusNotFound}, failureNetwork},
+		{&statusError{http.StatusBadGateway}, failureNetwork},
+		{&statusError{http.StatusServiceUnavailable}, failureNetwork},
+		{websocket.ErrBadStatus, failureNetwork},
+		{&sessionError{err: errors.New("closed"), duration: time.Second}, failureSession},
+		{errors.New("connection refused"), failureNetwork},
+	}
+	for _, tt := range tests {
+		if got := classifyFailure(tt.err); got != tt.want {
+			t.Errorf("classifyFailure(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStatusConn(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   int
+	}{
+		{[]string{"HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"}, 403},
+		{[]string{"HTTP/1.1 50", "3 Service Unavailable\r\n", "HTTP/1.1 200 OK\r\n"}, 503},
+		{[]string{"garbage"}, 0},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			for _, w := range tt.writes {
+				server.Write([]byte(w))
+			}
+			server.Close()
+		}()
+		c := &statusConn{Conn: client}
+		io.Copy(io.Discard, c)
+		if got := c.statusCode(); got != tt.want {
+			t.Errorf("statusCode() of %q = %d, want %d", tt.writes, got, tt.want)
+		}
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	endpoints := []*Endpoint{{URL: "https://127.0.0.1:1"}}
+	c, err := New(Config{Endpoints: endpoints, Logger: discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cfg.ReconnectDelay <= 0 || c.cfg.ReconnectMaxDelay <= 0 || c.cfg.ReconnectReset <= 0 {
+		t.Errorf("reconnection delays %s, %s and %s, want the defaults",
+			c.cfg.ReconnectDelay, c.cfg.ReconnectMaxDelay, c.cfg.ReconnectReset)
+	}
+	if _, err := New(Config{Endpoints: endpoints, ReconnectReset: -time.Second}); err == nil {
+		t.Error("New() with a negative ReconnectReset = nil error, want an error")
+	}
+}
+
+// TestRunDroppedSessions checks that the sessions dropped right away count as failures with the default
+// ReconnectReset, instead of reconnecting at once forever.
+func TestRunDroppedSessions(t *testing.T) {
+	cert := testutil.NewCert(t, nil)
+	var sessions atomic.Int32
+	ts := httptest.NewUnstartedServer(websocket.Handler(func(conn *websocket.Conn) {
+		sessions.Add(1)
+		conn.Close()
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS()}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := New(Config{
+		Endpoints:      []*Endpoint{{URL: ts.URL, TLSCert: cert.WritePEM(t)}},
+		ReconnectLimit: 3,
+		ReconnectDelay: time.Millisecond,
+		Logger:         discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run() = nil, want the reconnection limit reached")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run() still reconnecting after %d sessions", sessions.Load())
+	}
+	if n := sessions.Load(); n != 3 {
+		t.Errorf("%d sessions, want 3", n)
+	}
+}
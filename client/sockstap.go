@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/metala/revwebsocks5/internal/socks"
+)
+
+// socksTapSize is enough for the longest SOCKS5 greeting and request, or method selection and reply.
+const socksTapSize = 1024
+
+// countingConn counts the bytes read and written through the connection.
+type countingConn struct {
+	net.Conn
+
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// socksTapConn counts the bytes of the SOCKS5 connection and keeps the beginning of the exchange,
+// to parse the request and the reply once the connection is served.
+type socksTapConn struct {
+	countingConn
+
+	in  []byte
+	out []byte
+}
+
+func (c *socksTapConn) Read(p []byte) (int, error) {
+	n, err := c.countingConn.Read(p)
+	c.in = tap(c.in, p[:n])
+	return n, err
+}
+
+func (c *socksTapConn) Write(p []byte) (int, error) {
+	n, err := c.countingConn.Write(p)
+	c.out = tap(c.out, p[:n])
+	return n, err
+}
+
+func tap(buf, p []byte) []byte {
+	if free := socksTapSize - len(buf); free > 0 {
+		if len(p) > free {
+			p = p[:free]
+		}
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// request parses the request following the greeting of the client.
+func (c *socksTapConn) request() *socks.Request {
+	if len(c.in) < 2 || len(c.in) < 2+int(c.in[1]) {
+		return nil
+	}
+	req, _ := socks.ReadRequest(bytes.NewReader(c.in[2+int(c.in[1]):]))
+	return req
+}
+
+// reply parses the reply following the method selection of the SOCKS5 server.
+func (c *socksTapConn) reply() *socks.Request {
+	if len(c.out) < 2 {
+		return nil
+	}
+	reply, _ := socks.ReadRequest(bytes.NewReader(c.out[2:]))
+	return reply
+}
+
+// recordingResolver records the last address resolved by the SOCKS5 server.
+type recordingResolver struct {
+	socks5.NameResolver
+	ip net.IP
+}
+
+func (r *recordingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ip, err := r.NameResolver.Resolve(ctx, name)
+	r.ip = ip
+	return ctx, ip, err
+}
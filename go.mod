@@ -1,12 +1,15 @@
 module github.com/metala/revwebsocks5
 
-go 1.19
+go 1.21
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	github.com/hashicorp/yamux v0.1.1
 	github.com/refraction-networking/utls v1.3.3
+	github.com/robertkrimen/otto v0.2.1
 	github.com/spf13/cobra v1.7.0
+	github.com/spf13/pflag v1.0.5
 	golang.org/x/net v0.11.0
 )
 
@@ -15,7 +18,8 @@ require (
 	github.com/gaukas/godicttls v0.0.3 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/klauspost/compress v1.16.6 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/crypto v0.10.0 // indirect
 	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.10.0 // indirect
+	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 )
@@ -0,0 +1,145 @@
+// Package netutil listens on the TCP addresses and the unix domain sockets of the flags.
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UnixPrefix prefixes the unix domain socket paths of the listen addresses.
+const UnixPrefix = "unix:"
+
+// Listen listens on a TCP address:port or, when prefixed by "unix:", on a unix domain socket path.
+// The unix sockets get the mode, unless 0, and the owner as user[:group], unless empty.
+func Listen(address string, mode fs.FileMode, owner string) (net.Listener, error) {
+	if !strings.HasPrefix(address, UnixPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, UnixPrefix)
+
+	removeStaleSocket(path)
+	if mode == 0 && owner == "" {
+		return net.Listen("unix", path)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return nil, &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: syscall.EADDRINUSE}
+	}
+
+	// The socket is created in a private directory and moved in place once it has its mode and owner,
+	// so that it's never reachable with the permissions of the umask.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".s")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err := setSocketPerms(tmp, mode, owner); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return &unixListener{ul, path}, nil
+}
+
+// unixListener removes its socket file, which it was moved to, on Close.
+type unixListener struct {
+	*net.UnixListener
+
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// removeStaleSocket removes a socket file left behind by a previous process, unless something still listens on it.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&fs.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// ParseMode parses an octal file mode, as given to --socket-mode. The empty mode is 0.
+func ParseMode(s string) (fs.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode '%s': %w", s, err)
+	}
+	return fs.FileMode(mode), nil
+}
+
+func setSocketPerms(path string, mode fs.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupOwner resolves an owner in the form of user[:group], by name or numeric id.
+// It returns -1 for the group if it's not specified.
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	username, group, _ := strings.Cut(owner, ":")
+	if username == "" {
+		return 0, 0, errors.New("socket owner requires a user")
+	}
+	uid, err = strconv.Atoi(username)
+	if err != nil {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	gid = -1
+	if group != "" {
+		gid, err = strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
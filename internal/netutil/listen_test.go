@@ -0,0 +1,76 @@
+package netutil
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "socks")
+	ln, err := Listen(UnixPrefix+path, 0600, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want a socket with 0600", fi.Mode())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d entries in the directory, want the socket only", len(entries))
+	}
+
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after Close: %v", err)
+	}
+}
+
+func TestListenUnixErrors(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(UnixPrefix+file, 0600, ""); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen() on a file = %v, want EADDRINUSE", err)
+	}
+	if _, err := Listen(UnixPrefix+filepath.Join(dir, "missing", "socks"), 0600, ""); err == nil || errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen() in a missing directory = %v, want another error than EADDRINUSE", err)
+	}
+	if _, err := Listen(UnixPrefix+filepath.Join(dir, "missing", "socks"), 0, ""); err == nil || errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen() in a missing directory = %v, want another error than EADDRINUSE", err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if mode, err := ParseMode("0660"); err != nil || mode != 0660 {
+		t.Errorf("ParseMode(0660) = %v, %v", mode, err)
+	}
+	if mode, err := ParseMode(""); err != nil || mode != 0 {
+		t.Errorf("ParseMode() = %v, %v", mode, err)
+	}
+	if _, err := ParseMode("0999"); err == nil {
+		t.Error("ParseMode(0999) = nil error, want an error")
+	}
+}
@@ -0,0 +1,232 @@
+// Package socks implements the parts of the SOCKS5 protocol handled by the server and the agent themselves.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants
+const (
+	Version      = 0x05
+	NoAuth       = 0x00
+	UserPass     = 0x02
+	NoAcceptable = 0xff
+
+	UserPassVersion = 0x01
+
+	Connect = 0x01
+
+	IPv4   = 0x01
+	Domain = 0x03
+	IPv6   = 0x04
+
+	MaxHostLen = 255 // longest domain name, its length being a byte
+
+	Succeeded          = 0x00
+	GeneralFailure     = 0x01
+	NotAllowed         = 0x02
+	NetworkUnreachable = 0x03
+	HostUnreachable    = 0x04
+	ConnectionRefused  = 0x05
+	TTLExpired         = 0x06
+	CommandUnsupported = 0x07
+	AddressUnsupported = 0x08
+)
+
+var replyNames = map[byte]string{
+	Succeeded:          "succeeded",
+	GeneralFailure:     "general-failure",
+	NotAllowed:         "not-allowed",
+	NetworkUnreachable: "network-unreachable",
+	HostUnreachable:    "host-unreachable",
+	ConnectionRefused:  "connection-refused",
+	TTLExpired:         "ttl-expired",
+	CommandUnsupported: "command-unsupported",
+	AddressUnsupported: "address-unsupported",
+}
+
+// ReplyName returns the name of the reply code, as logged and audited.
+func ReplyName(code byte) string {
+	if name, ok := replyNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// Request is a SOCKS5 request read by the server, to forward it to the agent as is or rewritten.
+type Request struct {
+	Cmd  byte
+	Host string // domain name or IP address
+	Port uint16
+}
+
+func (r *Request) String() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// IsDomain reports whether the request is for a domain name rather than an IP address.
+func (r *Request) IsDomain() bool {
+	return net.ParseIP(r.Host) == nil
+}
+
+// Bytes encodes the request in the SOCKS5 wire format.
+func (r *Request) Bytes() []byte {
+	return append([]byte{Version, r.Cmd, 0}, r.AddrBytes()...)
+}
+
+// AddrBytes encodes the address type, the address and the port of the request.
+// The domain name must not be longer than MaxHostLen.
+func (r *Request) AddrBytes() []byte {
+	var b []byte
+	ip := net.ParseIP(r.Host)
+	switch {
+	case ip == nil:
+		b = append(b, Domain, byte(len(r.Host)))
+		b = append(b, r.Host...)
+	case ip.To4() != nil:
+		b = append(b, IPv4)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, IPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, r.Port)
+}
+
+// Handshake answers the SOCKS5 greeting of the client and reads the request. Without auth, it accepts
+// only no authentication, otherwise only the username and password checked by auth, and returns the username.
+func Handshake(rw io.ReadWriter, auth func(user, password string) bool) (*Request, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return nil, "", err
+	}
+	if hdr[0] != Version {
+		return nil, "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return nil, "", err
+	}
+	wanted := byte(NoAuth)
+	if auth != nil {
+		wanted = UserPass
+	}
+	method := byte(NoAcceptable)
+	for _, m := range methods {
+		if m == wanted {
+			method = wanted
+		}
+	}
+	if _, err := rw.Write([]byte{Version, method}); err != nil {
+		return nil, "", err
+	}
+	if method == NoAcceptable {
+		return nil, "", errors.New("no acceptable SOCKS authentication method")
+	}
+	var user string
+	if auth != nil {
+		var err error
+		if user, err = userPassAuth(rw, auth); err != nil {
+			return nil, user, err
+		}
+	}
+	req, err := ReadRequest(rw)
+	return req, user, err
+}
+
+// userPassAuth runs the username and password authentication of RFC 1929.
+func userPassAuth(rw io.ReadWriter, auth func(user, password string) bool) (string, error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return "", err
+	}
+	if ver[0] != UserPassVersion {
+		return "", fmt.Errorf("unsupported SOCKS authentication version %d", ver[0])
+	}
+	user, err := readString(rw)
+	if err != nil {
+		return "", err
+	}
+	password, err := readString(rw)
+	if err != nil {
+		return user, err
+	}
+	status := byte(0)
+	if !auth(user, password) {
+		status = 1
+	}
+	if _, err := rw.Write([]byte{UserPassVersion, status}); err != nil {
+		return user, err
+	}
+	if status != 0 {
+		return user, fmt.Errorf("invalid SOCKS credentials for user '%s'", user)
+	}
+	return user, nil
+}
+
+// readString reads a string prefixed with its 1 byte length.
+func readString(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, size[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ReadRequest reads a SOCKS5 request. It also reads the replies, which have the same format
+// with the reply code in Cmd and the bound address.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	return ReadAddr(r, hdr[1], hdr[3])
+}
+
+// ReadAddr reads the address of the type and the port, following the command of a request.
+func ReadAddr(r io.Reader, cmd, addrType byte) (*Request, error) {
+	req := &Request{Cmd: cmd}
+	switch addrType {
+	case IPv4, IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		req.Host = ip.String()
+	case Domain:
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		req.Host = name
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", addrType)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	req.Port = binary.BigEndian.Uint16(port[:])
+	return req, nil
+}
+
+// WriteReply writes a SOCKS5 reply with an empty bound address, for the requests failing on the server.
+func WriteReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{Version, code, 0, IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,124 @@
+// Package testutil has the fixtures shared by the tests of the packages.
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serial int64
+
+// Cert is a test certificate with its key, signed by its parent or self-signed without one.
+type Cert struct {
+	Cert   *x509.Certificate
+	Key    *ecdsa.PrivateKey
+	Parent *Cert
+}
+
+// NewCert returns a certificate for localhost and 127.0.0.1 valid for the hour around now, signed by parent
+// if not nil, with the template changed by the options.
+func NewCert(t testing.TB, parent *Cert, options ...func(*x509.Certificate)) *Cert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(atomic.AddInt64(&serial, 1)),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	for _, o := range options {
+		o(tmpl)
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cert{cert, key, parent}
+}
+
+// CA makes the certificate a CA one.
+func CA(c *x509.Certificate) {
+	c.IsCA = true
+	c.Subject.CommonName = "ca"
+	c.DNSNames, c.IPAddresses = nil, nil
+}
+
+// Expired makes the certificate expired an hour ago.
+func Expired(c *x509.Certificate) {
+	c.NotBefore = time.Now().Add(-2 * time.Hour)
+	c.NotAfter = time.Now().Add(-time.Hour)
+}
+
+// Hosts makes the certificate valid for the host names and IP addresses instead.
+func Hosts(hosts ...string) func(*x509.Certificate) {
+	return func(c *x509.Certificate) {
+		c.Subject.CommonName = hosts[0]
+		c.DNSNames, c.IPAddresses = nil, nil
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				c.IPAddresses = append(c.IPAddresses, ip)
+			} else {
+				c.DNSNames = append(c.DNSNames, h)
+			}
+		}
+	}
+}
+
+// Chain returns the DER certificates from c up to its root.
+func (c *Cert) Chain() [][]byte {
+	var chain [][]byte
+	for ; c != nil; c = c.Parent {
+		chain = append(chain, c.Cert.Raw)
+	}
+	return chain
+}
+
+// TLS returns the certificate and its chain for a tls.Config.
+func (c *Cert) TLS() tls.Certificate {
+	return tls.Certificate{Certificate: c.Chain(), PrivateKey: c.Key}
+}
+
+// Pin returns the pin of the certificate public key.
+func (c *Cert) Pin() string {
+	sum := sha256.Sum256(c.Cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WritePEM writes the certificate to a PEM file of a test directory and returns its name.
+func (c *Cert) WritePEM(t testing.TB) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
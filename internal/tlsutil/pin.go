@@ -0,0 +1,120 @@
+// Package tlsutil loads the certificates and the public key pins verifying the TLS peers.
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PinPrefix prefixes the base64 SHA-256 of the pins.
+const PinPrefix = "sha256//"
+
+// Pinset is a set of pinned public keys, each one the SHA-256 of the certificate SPKI.
+type Pinset [][]byte
+
+// ParsePins parses the pins in the form of sha256//<base64>.
+func ParsePins(list []string) (Pinset, error) {
+	var pins Pinset
+	for _, p := range list {
+		if !strings.HasPrefix(p, PinPrefix) {
+			return nil, fmt.Errorf("invalid pin '%s': expected %s<base64>", p, PinPrefix)
+		}
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, PinPrefix))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin '%s'", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// VerifyChain verifies the chain of the peer for the server name against the roots at the current time, as
+// the TLS handshake does, and with pins, requires a certificate of a verified chain to have a pinned public key.
+// The presented certificates with a pinned public key are trusted as roots too, so that a self-signed
+// certificate, or the one of a private CA, can be pinned without its file.
+func VerifyChain(rawCerts [][]byte, roots *x509.CertPool, serverName string, pins Pinset) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+	if roots == nil {
+		roots = x509.NewCertPool()
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		if len(pins) > 0 && pins.matches(cert) {
+			if opts.Roots == roots {
+				opts.Roots = roots.Clone()
+			}
+			opts.Roots.AddCert(cert)
+		}
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil || len(pins) == 0 {
+		return err
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pins.matches(cert) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate of the verified chains matches the pinned public keys")
+}
+
+// Verifier returns the tls.Config.VerifyPeerCertificate function of VerifyChain,
+// for a configuration with InsecureSkipVerify, which skips the verification of the handshake.
+func (ps Pinset) Verifier(roots *x509.CertPool, serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return VerifyChain(rawCerts, roots, serverName, ps)
+	}
+}
+
+func (ps Pinset) matches(cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range ps {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCertPool loads the PEM certificates of the file, or the system certificates without a file.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	if filename == "" {
+		return x509.SystemCertPool()
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	certs := x509.NewCertPool()
+	ok := certs.AppendCertsFromPEM(data)
+	if !ok {
+		return nil, errors.New("failed to parse RootCAs")
+	}
+	return certs, nil
+}
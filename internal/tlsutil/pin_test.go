@@ -0,0 +1,69 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"github.com/metala/revwebsocks5/internal/testutil"
+)
+
+func TestVerifyChain(t *testing.T) {
+	ca := testutil.NewCert(t, nil, testutil.CA)
+	leaf := testutil.NewCert(t, ca)
+	otherHost := testutil.NewCert(t, ca, testutil.Hosts("other.example.com"))
+	expired := testutil.NewCert(t, ca, testutil.Expired)
+	selfSigned := testutil.NewCert(t, nil)
+	forged := testutil.NewCert(t, nil)
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca.Cert)
+
+	tests := []struct {
+		name  string
+		roots *x509.CertPool
+		pin   *testutil.Cert
+		chain [][]byte
+		ok    bool
+	}{
+		{"trusted without pin", trusted, nil, leaf.Chain(), true},
+		{"untrusted without pin", nil, nil, leaf.Chain(), false},
+		{"leaf pinned", nil, leaf, leaf.Chain(), true},
+		{"self-signed pinned", nil, selfSigned, selfSigned.Chain(), true},
+		{"issuer pinned", nil, ca, leaf.Chain(), true},
+		{"trusted with issuer pinned", trusted, ca, leaf.Chain(), true},
+		{"trusted with other key pinned", trusted, selfSigned, leaf.Chain(), false},
+		{"other key", nil, selfSigned, leaf.Chain(), false},
+		{"issuer pinned with other host leaf", nil, ca, otherHost.Chain(), false},
+		{"issuer pinned with expired leaf", nil, ca, expired.Chain(), false},
+		{"other host leaf pinned", nil, otherHost, otherHost.Chain(), false},
+		{"forged leaf with pinned issuer appended", nil, ca, [][]byte{forged.Cert.Raw, ca.Cert.Raw}, false},
+		{"forged leaf with pinned leaf appended", nil, selfSigned, [][]byte{forged.Cert.Raw, selfSigned.Cert.Raw}, false},
+		{"forged leaf with pinned chain appended", nil, leaf, append([][]byte{forged.Cert.Raw}, leaf.Chain()...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pins Pinset
+			if tt.pin != nil {
+				var err error
+				if pins, err = ParsePins([]string{tt.pin.Pin()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := VerifyChain(tt.chain, tt.roots, "localhost", pins)
+			if tt.ok && err != nil {
+				t.Errorf("VerifyChain() = %v, want nil", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("VerifyChain() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	for _, p := range []string{"abc", "sha256//not base64", "sha256//" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParsePins([]string{p}); err == nil {
+			t.Errorf("ParsePins(%q) = nil error, want an error", p)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package tunnel
 
 import (
 	"crypto/rand"
@@ -22,3 +22,11 @@ func RandString(n int) string {
 	}
 	return string(b)
 }
+
+// RandBytes generates random bytes of n size
+// It returns the generated random bytes
+func RandBytes(n int) []byte {
+	r := make([]byte, n)
+	_, _ = rand.Read(r)
+	return r
+}
@@ -0,0 +1,119 @@
+// Package tunnel holds the protocol shared by the server and the agent on top of the yamux session.
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream types, sent as the first byte of the streams opened by the server.
+// The SOCKS5 streams are recognized by the SOCKS protocol version itself.
+// The connect streams carry a destination already parsed and approved by the server. The resolve streams
+// are connect streams, for which the agent reports the address the name resolves to, and connects
+// only once the server approves it.
+const (
+	StreamSocks5  byte = 0x05
+	StreamDNS     byte = 0x35
+	StreamConnect byte = 0x43
+	StreamResolve byte = 0x52
+	StreamGoodbye byte = 0xff
+)
+
+// The yamux frame header fields, as parsed by the capture and the debug decoder.
+const (
+	YamuxHeaderSize = 12
+
+	YamuxTypeData         = 0
+	YamuxTypeWindowUpdate = 1
+	YamuxTypePing         = 2
+	YamuxTypeGoAway       = 3
+
+	YamuxFlagSYN = 0x1
+	YamuxFlagACK = 0x2
+	YamuxFlagFIN = 0x4
+	YamuxFlagRST = 0x8
+)
+
+// GoodbyeTimeout is the time the server waits for the client to acknowledge the goodbye.
+const GoodbyeTimeout = 2 * time.Second
+
+// ErrGoodbye is returned when the server goes away and the client should reconnect without delay.
+var ErrGoodbye = errors.New("server is going away")
+
+// BufferedConn is a net.Conn, which reads through a buffer that may already hold peeked data.
+type BufferedConn struct {
+	net.Conn
+
+	Reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{conn, bufio.NewReader(conn)}
+}
+
+// StreamType returns the type of the stream without consuming it.
+func (c *BufferedConn) StreamType() (byte, error) {
+	b, err := c.Reader.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// SendGoodbye tells the client over the stream that the server is going away.
+// It waits for the client to acknowledge it by closing the stream.
+func SendGoodbye(stream net.Conn, timeout time.Duration) error {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(timeout))
+	if _, err := stream.Write([]byte{StreamGoodbye}); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
+// WaitTimeout waits for the wait group up to the timeout.
+// It returns false if the timeout is reached.
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ReadDNSMessage reads a message with the 2 bytes length prefix of DNS over TCP.
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func WriteDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too long")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/metala/revwebsocks5/internal/tunnel"
 	"github.com/spf13/cobra"
 )
 
@@ -77,13 +78,13 @@ func genKeyCert() (key []byte, cert []byte) {
 	ca := &x509.Certificate{
 		SerialNumber: RandBigInt(serialNumberLimit),
 		Subject: pkix.Name{
-			Country:            []string{RandString(16)},
-			Organization:       []string{RandString(16)},
-			OrganizationalUnit: []string{RandString(16)},
+			Country:            []string{tunnel.RandString(16)},
+			Organization:       []string{tunnel.RandString(16)},
+			OrganizationalUnit: []string{tunnel.RandString(16)},
 		},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(10, 0, 0),
-		SubjectKeyId:          RandBytes(5),
+		SubjectKeyId:          tunnel.RandBytes(5),
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
@@ -114,14 +115,6 @@ func genKeyCert() (key []byte, cert []byte) {
 
 }
 
-// RandBytes generates random bytes of n size
-// It returns the generated random bytes
-func RandBytes(n int) []byte {
-	r := make([]byte, n)
-	_, _ = rand.Read(r)
-	return r
-}
-
 // RandBigInt generates random big integer with max number
 // It returns the generated random big integer
 func RandBigInt(max *big.Int) *big.Int {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// tlsKeyLog gets the TLS secrets in the NSS key log format, nil without --tls-keylog or SSLKEYLOGFILE.
+var tlsKeyLog io.Writer
+
+// openKeyLog opens the TLS key log of the --tls-keylog flag, or of the SSLKEYLOGFILE variable, for appending.
+func openKeyLog() error {
+	filename := tlsKeyLogFile
+	if filename == "" {
+		filename = os.Getenv("SSLKEYLOGFILE")
+	}
+	if filename == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	slog.Warn("Logging the TLS secrets, the captured sessions can be decrypted", "file", filename)
+	tlsKeyLog = f
+	return nil
+}
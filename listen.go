@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+
+	"github.com/metala/revwebsocks5/internal/netutil"
+)
+
+// listenAddr listens on a TCP address:port or, when prefixed by "unix:", on a unix domain socket path.
+// The unix sockets get the mode and owner specified by --socket-mode and --socket-owner.
+func listenAddr(address string) (net.Listener, error) {
+	mode, err := netutil.ParseMode(socketMode)
+	if err != nil {
+		return nil, err
+	}
+	return netutil.Listen(address, mode, socketOwner)
+}
+
+// isLocalListener reports whether the listener is on a unix socket or a loopback address.
+func isLocalListener(ln net.Listener) bool {
+	switch addr := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
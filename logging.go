@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// setupLogging installs the default structured logger for the --log-format and --log-level flags.
+// The standard log package goes through it at the info level.
+// The connection logs use the fields agent_id, remote_addr, client_addr, stream_id, dst, bytes and duration.
+func setupLogging() error {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	if logLevel != "" {
+		if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+			return fmt.Errorf("invalid log level '%s'", logLevel)
+		}
+	}
+	var w io.Writer = os.Stderr
+	if quiet {
+		w = io.Discard
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch logFormat {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format '%s', expected text or json", logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
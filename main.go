@@ -1,30 +1,76 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	debug bool
-	quiet bool
+	debug           bool
+	debugPayload    bool
+	debugDir        string
+	debugMaxSize    int64
+	debugMaxBackups int
+	debugMaxFiles   int
+	quiet           bool
+	logLevel        string
+	logFormat       string
 
-	listen         string
-	tlsKey         string
-	tlsCert        string
-	socksBind      string
-	socksPort      uint16
-	connect        string
-	proxies        []string
-	reconnectLimit int
-	reconnectDelay int
-	tlsSkipVerify  bool
-	password       string
-	userAgent      string
+	listen               string
+	tlsKey               string
+	tlsCert              string
+	socksBind            string
+	socksPort            uint16
+	dnsBind              string
+	dnsPort              uint16
+	connect              string
+	connects             []string
+	endpointsFile        string
+	tlsPins              []string
+	failbackInterval     int
+	proxies              []string
+	proxyFromEnvironment bool
+	proxyPAC             string
+	proxyCredentials     string
+	proxyTLSCert         string
+	proxyTLSPins         []string
+	proxyTLSSkipVerify   bool
+	reconnectLimit       int
+	reconnectDelay       int
+	reconnectMaxDelay    int
+	reconnectReset       int
+	authFailureLimit     int
+	tlsSkipVerify        bool
+	password             string
+	userAgent            string
+	tunnelPaths          []string
+	fallback             string
+	noTLS                bool
+	trustedProxies       []string
+	trustedProxyHeader   string
+	socketMode           string
+	socketOwner          string
+	localListen          string
+	dnsPolicyFile        string
+	destPolicyFile       string
+	metricsListen        string
+	egressBind           string
+	egressInterface      string
+	resolverAddress      string
+	auditLogFile         string
+	auditLogMaxSize      int64
+	auditLogMaxBackups   int
+	captureFile          string
+	captureStreams       bool
+	tlsKeyLogFile        string
+
+	shutdownTimeout time.Duration
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -41,8 +87,16 @@ var rootCmd = &cobra.Command{
 3) Connect to 127.0.0.1:1080 on the host with any SOCKS5 client.
 4) Enjoy.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		if quiet {
-			log.SetOutput(ioutil.Discard)
+		if err := setupLogging(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := openKeyLog(); err != nil {
+			fatal("Failed to open the TLS key log", err)
+		}
+		var err error
+		if tracer, err = newTracer(); err != nil {
+			fatal("Failed to create the debug directory", err)
 		}
 	},
 }
@@ -58,11 +112,20 @@ var mooCmd = &cobra.Command{
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Be quiet")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "display debug info")
+	rootCmd.PersistentFlags().BoolVarP(&debugPayload, "debug-payload", "", false, "dump the tunnel payloads in hex in the traces")
+	rootCmd.PersistentFlags().StringVarP(&debugDir, "debug-dir", "", "", "write the traces of every connection and stream to files in this directory")
+	rootCmd.PersistentFlags().Int64VarP(&debugMaxSize, "debug-max-size", "", 10, "trace file size in MB triggering the rotation (0 to disable)")
+	rootCmd.PersistentFlags().IntVarP(&debugMaxBackups, "debug-max-backups", "", 1, "rotated trace files to keep per trace")
+	rootCmd.PersistentFlags().IntVarP(&debugMaxFiles, "debug-max-files", "", 1000, "trace files to keep in the debug directory (0 for all)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "log level: debug, info, warn or error (default info, or debug with --debug)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format: text or json")
 	rootCmd.AddCommand(mooCmd)
 }
 
 func main() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/metala/revwebsocks5/metrics"
+)
+
+// serveMetrics serves the /metrics endpoint of the registry on the address.
+func serveMetrics(address string, registry *metrics.Registry) error {
+	ln, err := listenAddr(address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	slog.Info("Serving metrics", "listen", address)
+	go func() {
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("Metrics listener failed", "err", err)
+		}
+	}()
+	return nil
+}
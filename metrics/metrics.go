@@ -0,0 +1,226 @@
+// Package metrics keeps the metrics of the server and the client, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// pingInterval is the interval of the yamux pings measuring the session round trip time.
+const pingInterval = 30 * time.Second
+
+// labelEscaper escapes the label values as the Prometheus text format does.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Registry keeps the metrics of a server or a client, served by its ServeHTTP.
+type Registry struct {
+	Agents          *Vec
+	AuthFailures    *Vec
+	SocksConns      *Vec
+	Streams         *Vec
+	Bytes           *Vec
+	StreamDuration  *Histogram
+	PingRTT         *Vec
+	Reconnects      *Vec
+	ConnectFailures *Vec
+
+	metrics []metric
+}
+
+// NewRegistry returns the registry of the metrics with no values.
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.Agents = r.newVec("gauge", "revwebsocks5_agents_connected", "Connected agents.")
+	r.AuthFailures = r.newVec("counter", "revwebsocks5_auth_failures_total", "Rejected agent authentications by reason.", "reason")
+	r.SocksConns = r.newVec("counter", "revwebsocks5_socks_connections_total", "SOCKS5 connections by result.", "result")
+	r.Streams = r.newVec("gauge", "revwebsocks5_streams_active", "Active yamux streams.")
+	r.Bytes = r.newVec("counter", "revwebsocks5_bytes_total", "Forwarded bytes by agent and direction, in from the agent or out to the agent.", "agent", "direction")
+	r.StreamDuration = r.newHistogram("revwebsocks5_stream_duration_seconds", "Duration of the forwarded streams.",
+		0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600)
+	r.PingRTT = r.newVec("gauge", "revwebsocks5_ping_rtt_seconds", "Round trip time of the yamux session ping by peer.", "peer")
+	r.Reconnects = r.newVec("counter", "revwebsocks5_reconnects_total", "Reconnections of the client.")
+	r.ConnectFailures = r.newVec("counter", "revwebsocks5_connect_failures_total", "Failed client connections by failure class.", "class")
+	return r
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// Vec is a counter or a gauge with labels.
+type Vec struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (r *Registry) newVec(kind, name, help string, labels ...string) *Vec {
+	m := &Vec{kind: kind, name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		m.values[""] = 0
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (m *Vec) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values", m.name, len(m.labels)))
+	}
+	pairs := make([]string, len(m.labels))
+	for i, l := range m.labels {
+		pairs[i] = l + `="` + labelEscaper.Replace(labelValues[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *Vec) Add(delta float64, labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	m.values[k] += delta
+	m.mu.Unlock()
+}
+
+// With returns the value of the metric with the label values, for the frequent updates.
+func (m *Vec) With(labelValues ...string) *Value {
+	return &Value{m, m.key(labelValues)}
+}
+
+func (m *Vec) Set(v float64, labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	m.values[k] = v
+	m.mu.Unlock()
+}
+
+func (m *Vec) Delete(labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	delete(m.values, k)
+	m.mu.Unlock()
+}
+
+func (m *Vec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(w, "%s %v\n", m.name, m.values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", m.name, k, m.values[k])
+		}
+	}
+}
+
+// Value is a value of a Vec with its label values.
+type Value struct {
+	m   *Vec
+	key string
+}
+
+func (v *Value) Add(delta float64) {
+	v.m.mu.Lock()
+	v.m.values[v.key] += delta
+	v.m.mu.Unlock()
+}
+
+// CountingWriter returns the writer adding the bytes written to w to the value.
+func (v *Value) CountingWriter(w io.Writer) io.Writer {
+	return countingWriter{w, v}
+}
+
+type countingWriter struct {
+	io.Writer
+
+	v *Value
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.v.Add(float64(n))
+	return n, err
+}
+
+// Histogram is a histogram without labels.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) newHistogram(name, help string, buckets ...float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.metrics = append(r.metrics, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, math.Inf(1), h.count)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// PingSession measures the round trip time of the session for the peer until it is closed.
+func (r *Registry) PingSession(session *yamux.Session, peer string) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer r.PingRTT.Delete(peer)
+	for {
+		if rtt, err := session.Ping(); err == nil {
+			r.PingRTT.Set(rtt.Seconds(), peer)
+		}
+		select {
+		case <-ticker.C:
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabelEscaping(t *testing.T) {
+	m := NewRegistry().newVec("counter", "test_escaping_total", "Escaping test.", "peer")
+	m.Add(1, "a\\b\"c\nd\té")
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := `test_escaping_total{peer="a\\b\"c\nd` + "\té" + `"} 1`
+	if !strings.Contains(buf.String(), want+"\n") {
+		t.Errorf("got\n%s\nwant the line %s", buf.String(), want)
+	}
+}
+
+// TestCountingWriter checks that the bytes are counted on every write, not once the copy ends.
+func TestCountingWriter(t *testing.T) {
+	m := NewRegistry().newVec("counter", "test_bytes_total", "Counting test.", "direction")
+	w := m.With("in").CountingWriter(io.Discard)
+	for i, want := range []float64{5, 10} {
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		m.mu.Lock()
+		got := m.values[`direction="in"`]
+		m.mu.Unlock()
+		if got != want {
+			t.Errorf("counted %v bytes after write %d, want %v", got, i+1, want)
+		}
+	}
+}
+
+// TestRegistries checks that the registries keep their own values, served in the Prometheus text format.
+func TestRegistries(t *testing.T) {
+	r1, r2 := NewRegistry(), NewRegistry()
+	r1.SocksConns.Add(2, "accepted")
+	r2.SocksConns.Add(1, "accepted")
+	for _, tt := range []struct {
+		r    *Registry
+		want string
+	}{
+		{r1, `revwebsocks5_socks_connections_total{result="accepted"} 2`},
+		{r2, `revwebsocks5_socks_connections_total{result="accepted"} 1`},
+	} {
+		w := httptest.NewRecorder()
+		tt.r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), tt.want+"\n") {
+			t.Errorf("got\n%s\nwant the line %s", w.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-ntlmssp"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+// proxyAuthenticator answers the authentication challenges of an HTTP proxy.
+type proxyAuthenticator interface {
+	// authorize returns the Proxy-Authorization header for the challenge of a 407 response.
+	authorize(req *http.Request, resp *http.Response) (string, error)
+}
+
+// authChallenge is a parsed Proxy-Authenticate challenge.
+type authChallenge struct {
+	scheme string
+	token  string
+	params map[string]string
+}
+
+// newProxyAuthenticator picks the strongest supported scheme offered by the proxy: NTLM, Digest or Basic.
+// NTLM is also used through Negotiate, which accepts raw NTLM tokens.
+func newProxyAuthenticator(resp *http.Response, username, password string) (proxyAuthenticator, error) {
+	challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+	if _, ok := challenges["ntlm"]; ok {
+		return &ntlmAuth{scheme: "NTLM", username: username, password: password}, nil
+	}
+	if _, ok := challenges["negotiate"]; ok {
+		return &ntlmAuth{scheme: "Negotiate", username: username, password: password}, nil
+	}
+	if _, ok := challenges["digest"]; ok {
+		return &digestAuth{username: username, password: password}, nil
+	}
+	if _, ok := challenges["basic"]; ok {
+		return &basicAuth{username: username, password: password}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy authentication %q", resp.Header.Values("Proxy-Authenticate"))
+}
+
+type basicAuth struct {
+	username string
+	password string
+	sent     bool
+}
+
+func (a *basicAuth) authorize(req *http.Request, resp *http.Response) (string, error) {
+	if a.sent {
+		return "", errors.New("proxy rejected the basic credentials")
+	}
+	a.sent = true
+	return basicAuthorization(a.username, a.password), nil
+}
+
+// basicAuthorization returns the Proxy-Authorization header of the Basic scheme.
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// ntlmAuth runs the NTLM negotiate, challenge and authenticate legs, which must happen on the same connection.
+type ntlmAuth struct {
+	scheme   string
+	username string
+	password string
+	leg      int
+}
+
+func (a *ntlmAuth) authorize(req *http.Request, resp *http.Response) (string, error) {
+	a.leg++
+	user, domain, domainNeeded := ntlmssp.GetDomain(a.username)
+	switch a.leg {
+	case 1:
+		msg, err := ntlmssp.NewNegotiateMessage(domain, "")
+		if err != nil {
+			return "", err
+		}
+		return a.scheme + " " + base64.StdEncoding.EncodeToString(msg), nil
+	case 2:
+		c, ok := parseChallenges(resp.Header.Values("Proxy-Authenticate"))[strings.ToLower(a.scheme)]
+		if !ok || c.token == "" {
+			return "", errors.New("proxy sent no NTLM challenge")
+		}
+		challenge, err := base64.StdEncoding.DecodeString(c.token)
+		if err != nil {
+			return "", fmt.Errorf("invalid NTLM challenge: %w", err)
+		}
+		msg, err := ntlmssp.ProcessChallenge(challenge, user, a.password, domainNeeded)
+		if err != nil {
+			return "", err
+		}
+		return a.scheme + " " + base64.StdEncoding.EncodeToString(msg), nil
+	}
+	return "", errors.New("proxy rejected the NTLM credentials")
+}
+
+// newCnonce returns the client nonce of the Digest responses.
+var newCnonce = func() string { return hex.EncodeToString(tunnel.RandBytes(8)) }
+
+// digestAuth computes the Digest responses (RFC 7616) with the MD5 and SHA-256 algorithms.
+type digestAuth struct {
+	username string
+	password string
+	nc       int
+	nonce    string
+}
+
+func (a *digestAuth) authorize(req *http.Request, resp *http.Response) (string, error) {
+	c, ok := parseChallenges(resp.Header.Values("Proxy-Authenticate"))["digest"]
+	if !ok {
+		return "", errors.New("proxy sent no Digest challenge")
+	}
+	nonce := c.params["nonce"]
+	if a.nonce == nonce && !strings.EqualFold(c.params["stale"], "true") {
+		return "", errors.New("proxy rejected the digest credentials")
+	}
+	if a.nonce != nonce {
+		a.nonce, a.nc = nonce, 0
+	}
+	a.nc++
+
+	algorithm := c.params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm '%s'", algorithm)
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	realm := c.params["realm"]
+	uri := req.URL.Host
+	cnonce := newCnonce()
+	nc := fmt.Sprintf("%08x", a.nc)
+	ha1 := h(a.username + ":" + realm + ":" + a.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	qop := ""
+	for _, q := range strings.Split(c.params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if qop != "" {
+		response = h(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", a.username),
+		fmt.Sprintf("realm=%q", realm),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+		"algorithm=" + algorithm,
+	}
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	if opaque, ok := c.params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// parseChallenges parses the Proxy-Authenticate header values by lowercase scheme.
+// A challenge has either a token (NTLM, Negotiate) or comma separated parameters (Basic, Digest).
+func parseChallenges(values []string) map[string]authChallenge {
+	challenges := make(map[string]authChallenge)
+	for _, v := range values {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(v), " ")
+		c := authChallenge{scheme: scheme, params: make(map[string]string)}
+		rest = strings.TrimSpace(rest)
+		switch strings.ToLower(scheme) {
+		case "ntlm", "negotiate":
+			c.token = rest
+		default:
+			for _, p := range splitAuthParams(rest) {
+				k, val, _ := strings.Cut(p, "=")
+				c.params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(val), `"`)
+			}
+		}
+		challenges[strings.ToLower(scheme)] = c
+	}
+	return challenges
+}
+
+// splitAuthParams splits the challenge parameters on the commas outside of quoted strings.
+func splitAuthParams(s string) []string {
+	var params []string
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\\' && quoted && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case ch == '"':
+			quoted = !quoted
+			b.WriteByte(ch)
+		case ch == ',' && !quoted:
+			if p := strings.TrimSpace(b.String()); p != "" {
+				params = append(params, p)
+			}
+			b.Reset()
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	if p := strings.TrimSpace(b.String()); p != "" {
+		params = append(params, p)
+	}
+	return params
+}
+
+// loadProxyCredentials returns the login and password for the proxy from a netrc formatted file.
+// The machine names are matched against the proxy host:port or hostname, the first match wins.
+func loadProxyCredentials(filename, host string) (username, password string, found bool, err error) {
+	hostname, _, splitErr := net.SplitHostPort(host)
+	if splitErr != nil {
+		hostname = host
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := s.Err(); err != nil {
+		return "", "", false, err
+	}
+
+	match := false
+	for i := 0; i < len(tokens); i++ {
+		if found && (tokens[i] == "machine" || tokens[i] == "default") {
+			break
+		}
+		switch tokens[i] {
+		case "machine":
+			if i+1 < len(tokens) {
+				i++
+				match = tokens[i] == host || tokens[i] == hostname
+			}
+		case "default":
+			match = true
+		case "login":
+			if i+1 < len(tokens) {
+				i++
+				if match {
+					username, found = tokens[i], true
+				}
+			}
+		case "password":
+			if i+1 < len(tokens) {
+				i++
+				if match {
+					password = tokens[i]
+				}
+			}
+		}
+	}
+	return username, password, found, nil
+}
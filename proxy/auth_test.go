@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// authRequest is a CONNECT request received by the fake proxy, with the index of its connection.
+type authRequest struct {
+	conn  int
+	authz string
+}
+
+// serveAuthProxy serves a fake HTTP proxy answering every CONNECT request with the status and the
+// Proxy-Authenticate challenges of handle. The connections are kept alive between the legs.
+func serveAuthProxy(t *testing.T, handle func(reqs []authRequest) (int, []string)) (string, func() []authRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	var reqs []authRequest
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil || req.Method != http.MethodConnect {
+						return
+					}
+					mu.Lock()
+					reqs = append(reqs, authRequest{conn: i, authz: req.Header.Get("Proxy-Authorization")})
+					status, challenges := handle(append([]authRequest(nil), reqs...))
+					mu.Unlock()
+
+					var b strings.Builder
+					fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+					for _, c := range challenges {
+						fmt.Fprintf(&b, "Proxy-Authenticate: %s\r\n", c)
+					}
+					if status != http.StatusOK {
+						b.WriteString("Content-Length: 0\r\n")
+					}
+					b.WriteString("\r\n")
+					if _, err := conn.Write([]byte(b.String())); err != nil || status == http.StatusOK {
+						return
+					}
+				}
+			}(i, conn)
+		}
+	}()
+	return ln.Addr().String(), func() []authRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]authRequest(nil), reqs...)
+	}
+}
+
+// dialAuthProxy connects through the fake proxy with the proxy URL credentials, if any.
+func dialAuthProxy(t *testing.T, cfg *Config, addr string, user *url.Userinfo) error {
+	t.Helper()
+	d, err := cfg.FromURL(&url.URL{Scheme: "http", Host: addr, User: user}, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "example.com:443")
+	if conn != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestHTTPProxyBasic(t *testing.T) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	tests := []struct {
+		name  string
+		user  *url.Userinfo
+		netrc string
+		authz []string
+		ok    bool
+	}{
+		{"preemptive URL credentials", url.UserPassword("user", "secret"), "", []string{basic}, true},
+		{"rejected URL credentials", url.UserPassword("user", "wrong"), "", []string{"Basic dXNlcjp3cm9uZw=="}, false},
+		{"netrc credentials on challenge", nil, "machine 127.0.0.1 login user password secret\n", []string{"", basic}, true},
+		{"no credentials", nil, "", []string{""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, reqs := serveAuthProxy(t, func(reqs []authRequest) (int, []string) {
+				if reqs[len(reqs)-1].authz == basic {
+					return http.StatusOK, nil
+				}
+				return http.StatusProxyAuthRequired, []string{`Basic realm="proxy"`}
+			})
+			cfg := &Config{}
+			if tt.netrc != "" {
+				cfg.Credentials = filepath.Join(t.TempDir(), "netrc")
+				if err := os.WriteFile(cfg.Credentials, []byte(tt.netrc), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := dialAuthProxy(t, cfg, addr, tt.user)
+			if tt.ok && err != nil {
+				t.Errorf("Dial() = %v, want nil", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("Dial() = nil, want an error")
+			}
+			var authz []string
+			for _, r := range reqs() {
+				authz = append(authz, r.authz)
+			}
+			if !reflect.DeepEqual(authz, tt.authz) {
+				t.Errorf("Proxy-Authorization = %q, want %q", authz, tt.authz)
+			}
+		})
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	defer func(f func() string) { newCnonce = f }(newCnonce)
+
+	// The examples of RFC 2617, section 3.5 and RFC 7616, section 3.9.1.
+	tests := []struct {
+		name      string
+		username  string
+		password  string
+		challenge string
+		cnonce    string
+		response  string
+	}{
+		{
+			"RFC 2617",
+			"Mufasa", "Circle Of Life",
+			`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			"0a4f113b",
+			"6629fae49393a05397450978507c4ef1",
+		},
+		{
+			"RFC 7616 MD5",
+			"Mufasa", "Circle of Life",
+			`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+			"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			"8ca523f5e9506fed4657c9700eebdbec",
+		},
+		{
+			"RFC 7616 SHA-256",
+			"Mufasa", "Circle of Life",
+			`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+			"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			"753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newCnonce = func() string { return tt.cnonce }
+			// The digest URI of a CONNECT request is the request host.
+			req := &http.Request{Method: http.MethodGet, URL: &url.URL{Host: "/dir/index.html"}}
+			resp := &http.Response{Header: http.Header{"Proxy-Authenticate": {tt.challenge}}}
+
+			a := &digestAuth{username: tt.username, password: tt.password}
+			authz, err := a.authorize(req, resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := parseChallenges([]string{authz})["digest"]
+			want := map[string]string{
+				"username": tt.username,
+				"uri":      "/dir/index.html",
+				"response": tt.response,
+				"qop":      "auth",
+				"nc":       "00000001",
+				"cnonce":   tt.cnonce,
+			}
+			for k, v := range want {
+				if c.params[k] != v {
+					t.Errorf("%s = %q, want %q", k, c.params[k], v)
+				}
+			}
+
+			// The same nonce is rejected, unless it is stale, which increments the nonce count.
+			if _, err := a.authorize(req, resp); err == nil {
+				t.Error("authorize() with the same nonce = nil, want an error")
+			}
+			resp.Header.Set("Proxy-Authenticate", tt.challenge+", stale=true")
+			if authz, err = a.authorize(req, resp); err != nil {
+				t.Fatal(err)
+			}
+			if nc := parseChallenges([]string{authz})["digest"].params["nc"]; nc != "00000002" {
+				t.Errorf("stale nc = %q, want 00000002", nc)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyDigest(t *testing.T) {
+	const challenge = `Digest realm="proxy", qop="auth", nonce="abc123", algorithm=SHA-256`
+	addr, reqs := serveAuthProxy(t, func(reqs []authRequest) (int, []string) {
+		c, ok := parseChallenges([]string{reqs[len(reqs)-1].authz})["digest"]
+		if ok && c.params["username"] == "user" && c.params["nonce"] == "abc123" && c.params["response"] != "" {
+			return http.StatusOK, nil
+		}
+		return http.StatusProxyAuthRequired, []string{`Basic realm="proxy"`, challenge}
+	})
+	if err := dialAuthProxy(t, &Config{}, addr, url.UserPassword("user", "secret")); err != nil {
+		t.Fatalf("Dial() = %v, want nil", err)
+	}
+	if n := len(reqs()); n != 2 {
+		t.Errorf("CONNECT requests = %d, want the preemptive Basic and the Digest response", n)
+	}
+}
+
+// ntlmChallenge returns a type 2 message with the unicode and NTLM flags, the server challenge
+// and no target information.
+func ntlmChallenge() []byte {
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], 0x00000201)
+	copy(msg[24:32], "12345678")
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return msg
+}
+
+// ntlmUserName returns the user name of a type 3 message.
+func ntlmUserName(msg []byte) (string, error) {
+	if len(msg) < 64 || string(msg[:8]) != "NTLMSSP\x00" || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return "", fmt.Errorf("not an authenticate message: %x", msg)
+	}
+	n, off := int(binary.LittleEndian.Uint16(msg[36:])), int(binary.LittleEndian.Uint32(msg[40:]))
+	if off+n > len(msg) || n%2 != 0 {
+		return "", fmt.Errorf("invalid user name field at %d+%d", off, n)
+	}
+	u := make([]uint16, n/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(msg[off+2*i:])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+func TestHTTPProxyNTLM(t *testing.T) {
+	for _, scheme := range []string{"NTLM", "Negotiate"} {
+		t.Run(scheme, func(t *testing.T) {
+			challenge := scheme + " " + base64.StdEncoding.EncodeToString(ntlmChallenge())
+			var userName string
+			addr, reqs := serveAuthProxy(t, func(reqs []authRequest) (int, []string) {
+				token, ok := strings.CutPrefix(reqs[len(reqs)-1].authz, scheme+" ")
+				if !ok {
+					return http.StatusProxyAuthRequired, []string{scheme}
+				}
+				msg, err := base64.StdEncoding.DecodeString(token)
+				if err != nil || len(msg) < 12 || string(msg[:8]) != "NTLMSSP\x00" {
+					return http.StatusBadRequest, nil
+				}
+				switch binary.LittleEndian.Uint32(msg[8:]) {
+				case 1:
+					return http.StatusProxyAuthRequired, []string{challenge}
+				case 3:
+					if userName, err = ntlmUserName(msg); err != nil {
+						return http.StatusBadRequest, nil
+					}
+					return http.StatusOK, nil
+				}
+				return http.StatusBadRequest, nil
+			})
+			if err := dialAuthProxy(t, &Config{}, addr, url.UserPassword(`DOMAIN\user`, "secret")); err != nil {
+				t.Fatalf("Dial() = %v, want nil", err)
+			}
+			if userName != "user" {
+				t.Errorf("authenticate user name = %q, want user", userName)
+			}
+
+			// The preemptive Basic, then the negotiate, challenge and authenticate legs on one connection.
+			got := reqs()
+			if len(got) != 3 {
+				t.Fatalf("CONNECT requests = %d, want 3", len(got))
+			}
+			if !strings.HasPrefix(got[0].authz, "Basic ") {
+				t.Errorf("first Proxy-Authorization = %q, want the preemptive Basic", got[0].authz)
+			}
+			for _, r := range got {
+				if r.conn != got[0].conn {
+					t.Errorf("NTLM legs on connections %d and %d, want one", got[0].conn, r.conn)
+				}
+			}
+		})
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	got := parseChallenges([]string{
+		`Basic realm="proxy, with a comma"`,
+		`Digest realm="a \"quoted\" realm", qop="auth,auth-int", nonce=abc, Stale=TRUE`,
+		`NTLM TlRMTVNTUAACAAAA`,
+		`Negotiate`,
+	})
+	want := map[string]authChallenge{
+		"basic": {scheme: "Basic", params: map[string]string{"realm": "proxy, with a comma"}},
+		"digest": {scheme: "Digest", params: map[string]string{
+			"realm": `a "quoted" realm`,
+			"qop":   "auth,auth-int",
+			"nonce": "abc",
+			"stale": "TRUE",
+		}},
+		"ntlm":      {scheme: "NTLM", token: "TlRMTVNTUAACAAAA", params: map[string]string{}},
+		"negotiate": {scheme: "Negotiate", params: map[string]string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseChallenges() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadProxyCredentials(t *testing.T) {
+	netrc := `# proxy credentials
+machine proxy.example.com:3128 login port password p1
+machine proxy.example.com
+  login host
+  password p2
+default login fallback password p3
+`
+	filename := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(filename, []byte(netrc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		username string
+		password string
+	}{
+		{"proxy.example.com:3128", "port", "p1"},
+		{"proxy.example.com:8080", "host", "p2"},
+		{"other.example.com:3128", "fallback", "p3"},
+	}
+	for _, tt := range tests {
+		username, password, found, err := loadProxyCredentials(filename, tt.host)
+		if err != nil || !found || username != tt.username || password != tt.password {
+			t.Errorf("loadProxyCredentials(%s) = %s, %s, %v, %v, want %s, %s", tt.host, username, password, found, err, tt.username, tt.password)
+		}
+	}
+
+	if err := os.WriteFile(filename, []byte("machine proxy.example.com login user password secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found, err := loadProxyCredentials(filename, "other.example.com:3128"); err != nil || found {
+		t.Errorf("loadProxyCredentials(other) = %v, %v, want not found", found, err)
+	}
+	if _, _, _, err := loadProxyCredentials(filepath.Join(t.TempDir(), "missing"), "proxy.example.com:3128"); err == nil {
+		t.Error("loadProxyCredentials(missing) = nil, want an error")
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// FromEnvironment returns the proxy for the server URL from HTTPS_PROXY, HTTP_PROXY or ALL_PROXY,
+// unless the host is excluded by NO_PROXY. It returns nil for a direct connection.
+func FromEnvironment(target *url.URL) (*url.URL, error) {
+	u := *target
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	}
+
+	cfg := httpproxy.FromEnvironment()
+	p, err := cfg.ProxyFunc()(&u)
+	if p != nil || err != nil {
+		return p, err
+	}
+
+	allProxy := getEnvAny("ALL_PROXY", "all_proxy")
+	if allProxy == "" {
+		return nil, nil
+	}
+	cfg = &httpproxy.Config{
+		HTTPProxy:  allProxy,
+		HTTPSProxy: allProxy,
+		NoProxy:    cfg.NoProxy,
+	}
+	return cfg.ProxyFunc()(&u)
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/metala/revwebsocks5/internal/tlsutil"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"github.com/metala/revwebsocks5/spy"
+	tls "github.com/refraction-networking/utls"
+	xproxy "golang.org/x/net/proxy"
+)
+
+type httpProxy struct {
+	cfg        *Config
+	host       string
+	haveAuth   bool
+	preemptive bool // send the Basic credentials without waiting for a challenge
+	username   string
+	password   string
+	forward    xproxy.Dialer
+	tlsConfig  *tls.Config
+}
+
+func (c *Config) newHTTPProxy(uri *url.URL, forward xproxy.Dialer) (xproxy.Dialer, error) {
+	p := new(httpProxy)
+	p.cfg = c
+	p.host = uri.Host
+	p.forward = forward
+	if uri.Port() == "" {
+		port := "80"
+		if uri.Scheme == "https" {
+			port = "443"
+		}
+		p.host = net.JoinHostPort(uri.Hostname(), port)
+	}
+	if uri.Scheme == "https" {
+		var err error
+		if p.tlsConfig, err = c.newTLSConfig(uri.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	if uri.User != nil {
+		p.haveAuth = true
+		p.preemptive = true
+		p.username = uri.User.Username()
+		p.password, _ = uri.User.Password()
+	} else if c.Credentials != "" {
+		username, password, found, err := loadProxyCredentials(c.Credentials, p.host)
+		if err != nil {
+			return nil, err
+		}
+		p.haveAuth = found
+		p.username = username
+		p.password = password
+	}
+
+	return p, nil
+}
+
+// maxAuthLegs limits the CONNECT requests answering the proxy authentication challenges.
+const maxAuthLegs = 4
+
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	conn, br, logger, err := p.dialProxy()
+	if err != nil {
+		return nil, err
+	}
+	var authz string
+	if p.preemptive {
+		authz = basicAuthorization(p.username, p.password)
+	}
+	resp, err := p.connect(conn, br, addr, authz, logger)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Answer the authentication challenges, keeping the connection, as NTLM requires.
+	var auth proxyAuthenticator
+	for leg := 0; resp.StatusCode == http.StatusProxyAuthRequired && p.haveAuth && leg < maxAuthLegs; leg++ {
+		if auth == nil {
+			if auth, err = newProxyAuthenticator(resp, p.username, p.password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if basic, ok := auth.(*basicAuth); ok {
+				// The preemptive credentials were rejected already.
+				basic.sent = p.preemptive
+			}
+		}
+		if authz, err = auth.authorize(resp.Request, resp); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.Close {
+			conn.Close()
+			if conn, br, logger, err = p.dialProxy(); err != nil {
+				return nil, err
+			}
+		}
+		if resp, err = p.connect(conn, br, addr, authz, logger); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("connect server using proxy error, StatusCode [%d]", resp.StatusCode)
+	}
+
+	if br.Buffered() > 0 {
+		return &tunnel.BufferedConn{Conn: conn, Reader: br}, nil
+	}
+	return conn, nil
+}
+
+func (c *Config) newTLSConfig(serverName string) (*tls.Config, error) {
+	certPool, err := tlsutil.LoadCertPool(c.TLSCert)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := tlsutil.ParsePins(c.TLSPins)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         tls.VersionTLS13,
+		RootCAs:            certPool,
+		InsecureSkipVerify: c.TLSSkipVerify || len(pins) > 0,
+		ServerName:         serverName,
+		NextProtos:         []string{"http/1.1"},
+		KeyLogWriter:       c.KeyLogWriter,
+	}
+	if len(pins) > 0 {
+		cfg.VerifyPeerCertificate = pins.Verifier(certPool, serverName)
+	}
+	return cfg, nil
+}
+
+// dialProxy connects to the proxy, and returns the logger of the connection trace when tracing.
+func (p *httpProxy) dialProxy() (net.Conn, *bufio.Reader, *log.Logger, error) {
+	// Dial and create the https client connection.
+	conn, err := p.forward.Dial("tcp", p.host)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if p.tlsConfig != nil {
+		conntls := tls.Client(conn, p.tlsConfig)
+		if err := conntls.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, nil, fmt.Errorf("TLS handshake with proxy %s: %w", p.host, err)
+		}
+		conn = conntls
+	}
+	var logger *log.Logger
+	if p.cfg.Tracer != nil {
+		logger = p.cfg.Tracer.Logger("proxy " + p.host)
+		conn = spy.NewConnSpy(conn, logger)
+	}
+	return conn, bufio.NewReader(conn), logger, nil
+}
+
+// connect sends the CONNECT request with the Proxy-Authorization, if any, and reads the response.
+// The response body is drained, so the connection can be reused for the next authentication leg.
+func (p *httpProxy) connect(conn net.Conn, br *bufio.Reader, addr string, authz string, logger *log.Logger) (*http.Response, error) {
+	// HACK. http.ReadRequest also does this.
+	reqURL, err := url.Parse("http://" + addr)
+	if err != nil {
+		return nil, err
+	}
+	reqURL.Scheme = ""
+
+	req, err := http.NewRequest("CONNECT", reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Close = false
+	if authz != "" {
+		req.Header.Set("Proxy-Authorization", authz)
+	}
+	if p.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", p.cfg.UserAgent)
+	}
+	req.Header.Set("Proxy-Connection", "Keep-Alive")
+
+	if logger != nil {
+		var buf bytes.Buffer
+		req.Write(&buf)
+		logger.Writer().Write(spy.RedactHeaders(buf.Bytes()))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		io.Copy(io.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	if p.cfg.ConnectTrace != nil {
+		p.cfg.ConnectTrace(p.host, resp)
+	}
+	return resp, nil
+}
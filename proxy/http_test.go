@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/metala/revwebsocks5/internal/testutil"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// serveTLSProxy serves a https:// proxy answering every CONNECT with 200, presenting the chain signed by key.
+func serveTLSProxy(t *testing.T, chain [][]byte, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: chain, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHTTPSProxyPin(t *testing.T) {
+	ca := testutil.NewCert(t, nil, testutil.CA)
+	leaf := testutil.NewCert(t, ca)
+	otherHost := testutil.NewCert(t, ca, testutil.Hosts("other.example.com"))
+	expired := testutil.NewCert(t, ca, testutil.Expired)
+	selfSigned := testutil.NewCert(t, nil)
+	forged := testutil.NewCert(t, nil)
+
+	tests := []struct {
+		name  string
+		pin   *testutil.Cert
+		chain [][]byte
+		key   *ecdsa.PrivateKey
+		ok    bool
+	}{
+		{"pinned certificate", selfSigned, selfSigned.Chain(), selfSigned.Key, true},
+		{"pinned issuer", ca, leaf.Chain(), leaf.Key, true},
+		{"pinned issuer with other host leaf", ca, otherHost.Chain(), otherHost.Key, false},
+		{"pinned issuer with expired leaf", ca, expired.Chain(), expired.Key, false},
+		{"forged certificate", selfSigned, forged.Chain(), forged.Key, false},
+		{"forged certificate with pinned certificate appended", selfSigned, [][]byte{forged.Cert.Raw, selfSigned.Cert.Raw}, forged.Key, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveTLSProxy(t, tt.chain, tt.key)
+			cfg := &Config{TLSPins: []string{tt.pin.Pin()}}
+			d, err := cfg.FromURL(&url.URL{Scheme: "https", Host: addr}, xproxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := d.Dial("tcp", "example.com:443")
+			if conn != nil {
+				conn.Close()
+			}
+			if tt.ok && err != nil {
+				t.Errorf("Dial() = %v, want nil", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("Dial() = nil, want a verification error")
+			}
+		})
+	}
+}
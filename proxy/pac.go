@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// pacTimeout limits the evaluation of FindProxyForURL.
+var pacTimeout = 5 * time.Second
+
+var errPACTimeout = errors.New("PAC evaluation timed out")
+
+// pacUtils are the standard PAC helper functions implemented in JavaScript.
+// The ones that need the network are implemented in Go.
+const pacUtils = `
+var pacDays = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var pacMonths = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function isResolvable(host) {
+	return dnsResolve(host) != null;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function shExpMatch(str, pattern) {
+	pattern = pattern.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + pattern + '$').test(str);
+}
+
+function pacNow() {
+	return new Date();
+}
+
+function pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args.length > 0 && args[args.length - 1] == 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	return {args: args, gmt: gmt, now: pacNow()};
+}
+
+function pacInRange(cur, from, to) {
+	return from <= to ? (from <= cur && cur <= to) : (cur >= from || cur <= to);
+}
+
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var day = a.gmt ? a.now.getUTCDay() : a.now.getDay();
+	var from = pacDays.indexOf(a.args[0]);
+	var to = a.args.length > 1 ? pacDays.indexOf(a.args[1]) : from;
+	return from >= 0 && to >= 0 && pacInRange(day, from, to);
+}
+
+function dateRange() {
+	var a = pacArgs(arguments);
+	var cur = {
+		d: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		m: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		y: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+	var vals = [];
+	for (var i = 0; i < a.args.length; i++) {
+		var v = a.args[i];
+		if (typeof v == 'string') {
+			vals.push({k: 'm', v: pacMonths.indexOf(v)});
+		} else {
+			vals.push({k: v > 31 ? 'y' : 'd', v: v});
+		}
+	}
+	if (vals.length == 1) {
+		return cur[vals[0].k] == vals[0].v;
+	}
+	if (vals.length == 0 || vals.length % 2 != 0) {
+		return false;
+	}
+	var weights = {y: 10000, m: 100, d: 1};
+	var from = 0, to = 0, now = 0;
+	for (var i = 0; i < vals.length / 2; i++) {
+		var k = vals[i].k;
+		from += weights[k] * vals[i].v;
+		to += weights[k] * vals[i + vals.length / 2].v;
+		now += weights[k] * cur[k];
+	}
+	return pacInRange(now, from, to);
+}
+
+function timeRange() {
+	var a = pacArgs(arguments), n = a.args;
+	var h = a.gmt ? a.now.getUTCHours() : a.now.getHours();
+	var m = a.gmt ? a.now.getUTCMinutes() : a.now.getMinutes();
+	var s = a.gmt ? a.now.getUTCSeconds() : a.now.getSeconds();
+	var cur = h * 3600 + m * 60 + s;
+	switch (n.length) {
+	case 1:
+		return h == n[0];
+	case 2:
+		return pacInRange(cur, n[0] * 3600, n[1] * 3600 - 1);
+	case 4:
+		return pacInRange(cur, n[0] * 3600 + n[1] * 60, n[2] * 3600 + n[3] * 60);
+	case 6:
+		return pacInRange(cur, n[0] * 3600 + n[1] * 60 + n[2], n[3] * 3600 + n[4] * 60 + n[5]);
+	}
+	return false;
+}
+`
+
+// PAC evaluates a proxy auto-config script.
+type PAC struct {
+	mu sync.Mutex
+	vm *otto.Otto
+}
+
+// LoadPAC loads the PAC script from a file or an http(s):// URL, which is fetched directly.
+func LoadPAC(location string) (*PAC, error) {
+	var script []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		script, err = fetchPAC(location)
+	} else {
+		script, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vm := otto.New()
+	vm.Set("dnsResolve", pacDNSResolve)
+	vm.Set("myIpAddress", pacMyIPAddress)
+	vm.Set("isInNet", pacIsInNet)
+	if _, err := vm.Run(pacUtils); err != nil {
+		return nil, err
+	}
+	if _, err := vm.Run(script); err != nil {
+		return nil, fmt.Errorf("PAC %s: %w", location, err)
+	}
+	if fn, err := vm.Get("FindProxyForURL"); err != nil || !fn.IsFunction() {
+		return nil, fmt.Errorf("PAC %s: FindProxyForURL is not defined", location)
+	}
+	return &PAC{vm: vm}, nil
+}
+
+func fetchPAC(location string) ([]byte, error) {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: nil},
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch PAC %s: %s", location, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// FindProxy returns the result of FindProxyForURL for the server URL.
+// The path and the default port are stripped, as browsers do for https:// URLs.
+func (p *PAC) FindProxy(target *url.URL) (result string, err error) {
+	scheme := target.Scheme
+	switch scheme {
+	case "wss":
+		scheme = "https"
+	case "ws":
+		scheme = "http"
+	}
+	host := target.Host
+	if (scheme == "https" && target.Port() == "443") || (scheme == "http" && target.Port() == "80") {
+		host = target.Hostname()
+	}
+	u := scheme + "://" + host + "/"
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(pacTimeout, func() {
+		p.vm.Interrupt <- func() {
+			panic(errPACTimeout)
+		}
+	})
+	defer timer.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errPACTimeout {
+				panic(r)
+			}
+			err = errPACTimeout
+		}
+	}()
+
+	v, err := p.vm.Call("FindProxyForURL", nil, u, target.Hostname())
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// ProxyChains returns the alternative proxy chains for the server URL in order of preference.
+// An empty chain is a direct connection.
+func (p *PAC) ProxyChains(target *url.URL) ([][]*url.URL, error) {
+	result, err := p.FindProxy(target)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePACResult(result)
+}
+
+// ParsePACResult parses a FindProxyForURL result, e.g. "PROXY proxy:8080; SOCKS proxy:1080; DIRECT".
+func ParsePACResult(result string) ([][]*url.URL, error) {
+	var chains [][]*url.URL
+	for _, alt := range strings.Split(result, ";") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			chains = append(chains, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid PAC result '%s'", alt)
+		}
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5h"
+		case "SOCKS4":
+			scheme = "socks4"
+		default:
+			return nil, fmt.Errorf("unknown PAC proxy type '%s'", fields[0])
+		}
+		chains = append(chains, []*url.URL{{Scheme: scheme, Host: fields[1]}})
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("empty PAC result '%s'", result)
+	}
+	return chains, nil
+}
+
+func pacDNSResolve(call otto.FunctionCall) otto.Value {
+	ip := pacResolve(call.Argument(0).String())
+	if ip == nil {
+		return otto.NullValue()
+	}
+	v, _ := otto.ToValue(ip.String())
+	return v
+}
+
+func pacMyIPAddress(call otto.FunctionCall) otto.Value {
+	ip := "127.0.0.1"
+	if conn, err := net.Dial("udp4", "198.51.100.1:53"); err == nil {
+		ip = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+	v, _ := otto.ToValue(ip)
+	return v
+}
+
+func pacIsInNet(call otto.FunctionCall) otto.Value {
+	ip := pacResolve(call.Argument(0).String())
+	pattern := net.ParseIP(call.Argument(1).String()).To4()
+	mask := net.ParseIP(call.Argument(2).String()).To4()
+	in := ip != nil && pattern != nil && mask != nil &&
+		ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask)))
+	v, _ := otto.ToValue(in)
+	return v
+}
+
+// pacResolve returns the IPv4 address of the host, as PAC scripts expect.
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
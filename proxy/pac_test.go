@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// loadTestPAC loads the PAC script from a local file.
+func loadTestPAC(t *testing.T, script string) *PAC {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(file, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pac, err := LoadPAC(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pac
+}
+
+func TestParsePACResult(t *testing.T) {
+	tests := []struct {
+		result string
+		want   []string // the chains as proxy URLs, "" for DIRECT
+	}{
+		{"DIRECT", []string{""}},
+		{"PROXY proxy:8080", []string{"http://proxy:8080"}},
+		{"PROXY proxy:8080; SOCKS socks:1080; DIRECT", []string{"http://proxy:8080", "socks5h://socks:1080", ""}},
+		{"HTTPS proxy:443;HTTP proxy:80", []string{"https://proxy:443", "http://proxy:80"}},
+		{"SOCKS5 socks:1080; SOCKS4 socks:1081;", []string{"socks5h://socks:1080", "socks4://socks:1081"}},
+		{"proxy proxy:8080; direct", []string{"http://proxy:8080", ""}},
+	}
+	for _, tt := range tests {
+		chains, err := ParsePACResult(tt.result)
+		if err != nil {
+			t.Errorf("ParsePACResult(%q) = %v", tt.result, err)
+			continue
+		}
+		var got []string
+		for _, chain := range chains {
+			s := ""
+			if len(chain) > 0 {
+				s = chain[0].String()
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePACResult(%q) = %q, want %q", tt.result, got, tt.want)
+		}
+	}
+
+	for _, result := range []string{"", " ; ", "PROXY", "PROXY a:1 b:2", "FTP proxy:21"} {
+		if _, err := ParsePACResult(result); err == nil {
+			t.Errorf("ParsePACResult(%q) = nil error, want an error", result)
+		}
+	}
+}
+
+func TestPACHelpers(t *testing.T) {
+	// The time is fixed to Tuesday 2024-01-02 03:04:05 UTC.
+	pac := loadTestPAC(t, `
+function pacNow() {
+	return new Date(Date.UTC(2024, 0, 2, 3, 4, 5));
+}
+
+function FindProxyForURL(url, host) {
+	return String(eval(host));
+}`)
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`shExpMatch("www.example.com", "*.example.com")`, true},
+		{`shExpMatch("example.com", "*.example.com")`, false},
+		{`shExpMatch("a.b", "a?b")`, true},
+		{`shExpMatch("axb", "a.b")`, false},
+		{`shExpMatch("a+b", "a+b")`, true},
+		{`shExpMatch("http://intra/x/y", "*/x/*")`, true},
+		{`dnsDomainIs("www.example.com", ".example.com")`, true},
+		{`dnsDomainIs("www.example.org", ".example.com")`, false},
+		{`dnsDomainIs("com", ".example.com")`, false},
+		{`timeRange(3, "GMT")`, true},
+		{`timeRange(4, "GMT")`, false},
+		{`timeRange(2, 4, "GMT")`, true},
+		{`timeRange(22, 4, "GMT")`, true},
+		{`timeRange(4, 22, "GMT")`, false},
+		{`timeRange(3, 0, 3, 5, "GMT")`, true},
+		{`timeRange(3, 5, 4, 0, "GMT")`, false},
+		{`timeRange(3, 4, 0, 3, 4, 10, "GMT")`, true},
+		{`timeRange(3, 4, 6, 3, 4, 10, "GMT")`, false},
+		{`dateRange(2, "GMT")`, true},
+		{`dateRange(3, "GMT")`, false},
+		{`dateRange("JAN", "GMT")`, true},
+		{`dateRange("FEB", "MAR", "GMT")`, false},
+		{`dateRange("DEC", "FEB", "GMT")`, true},
+		{`dateRange(2023, 2024, "GMT")`, true},
+		{`dateRange(1, "JAN", 3, "JAN", "GMT")`, true},
+		{`dateRange(3, "JAN", 2024, 5, "JAN", 2024, "GMT")`, false},
+		{`weekdayRange("TUE", "GMT")`, true},
+		{`weekdayRange("MON", "FRI", "GMT")`, true},
+		{`weekdayRange("SAT", "MON", "GMT")`, false},
+	}
+	for _, tt := range tests {
+		got, err := pac.FindProxy(&url.URL{Scheme: "https", Host: tt.expr})
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if want := map[bool]string{true: "true", false: "false"}[tt.want]; got != want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, want)
+		}
+	}
+}
+
+func TestPACProxyChains(t *testing.T) {
+	pac := loadTestPAC(t, `
+function FindProxyForURL(url, host) {
+	if (dnsDomainIs(host, ".corp.internal") || isPlainHostName(host)) {
+		return "DIRECT";
+	}
+	if (url.substring(0, 6) == "https:") {
+		return "PROXY proxy.corp.internal:3128; DIRECT";
+	}
+	return "SOCKS socks.corp.internal:1080";
+}`)
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"https://server.corp.internal:8443/tunnel", []string{""}},
+		{"https://intranet/", []string{""}},
+		{"wss://server.example.com/", []string{"http://proxy.corp.internal:3128", ""}},
+		{"ws://server.example.com/", []string{"socks5h://socks.corp.internal:1080"}},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.target)
+		chains, err := pac.ProxyChains(u)
+		if err != nil {
+			t.Errorf("ProxyChains(%s) = %v", tt.target, err)
+			continue
+		}
+		var got []string
+		for _, chain := range chains {
+			s := ""
+			if len(chain) > 0 {
+				s = chain[0].String()
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ProxyChains(%s) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPACTimeout(t *testing.T) {
+	defer func(d time.Duration) { pacTimeout = d }(pacTimeout)
+	pacTimeout = 100 * time.Millisecond
+	pac := loadTestPAC(t, `
+function FindProxyForURL(url, host) {
+	if (host == "loop") {
+		while (true) {}
+	}
+	return "DIRECT";
+}`)
+	started := time.Now()
+	if _, err := pac.FindProxy(&url.URL{Scheme: "https", Host: "loop"}); err != errPACTimeout {
+		t.Errorf("FindProxy() = %v, want %v", err, errPACTimeout)
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("FindProxy() took %v", d)
+	}
+	// The PAC still evaluates after a timeout.
+	if got, err := pac.FindProxy(&url.URL{Scheme: "https", Host: "server"}); err != nil || got != "DIRECT" {
+		t.Errorf("FindProxy() after the timeout = %q, %v, want DIRECT", got, err)
+	}
+}
+
+func TestLoadPACErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"syntax.pac":    "function FindProxyForURL(url, host) {",
+		"undefined.pac": "var x = 1;",
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(script), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPAC(file); err == nil {
+			t.Errorf("LoadPAC(%s) = nil error, want an error", name)
+		}
+	}
+	if _, err := LoadPAC(filepath.Join(dir, "missing.pac")); err == nil {
+		t.Error("LoadPAC(missing.pac) = nil error, want an error")
+	}
+}
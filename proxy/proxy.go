@@ -0,0 +1,76 @@
+// Package proxy dials through chains of HTTP(S), SOCKS4(a) and SOCKS5(h) proxies,
+// picked explicitly, by a PAC script or from the environment.
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/metala/revwebsocks5/spy"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Config configures the proxy dialers.
+type Config struct {
+	Credentials   string // netrc formatted file with the credentials of the proxies without userinfo
+	TLSCert       string // https:// proxy certificate file, the system certificates if empty
+	TLSPins       []string
+	TLSSkipVerify bool
+	KeyLogWriter  io.Writer
+	UserAgent     string
+	Tracer        *spy.Tracer
+
+	// ConnectTrace, if set, gets the proxy host:port and the response of every CONNECT request.
+	ConnectTrace func(host string, resp *http.Response)
+}
+
+// FromURL returns the dialer for the proxy URL, which connects through the forward dialer.
+// The socks5:// and socks4:// proxies get the addresses resolved locally, while
+// the socks5h:// and socks4a:// proxies get the host names to resolve them remotely,
+// as curl does: use the latter when the local resolver can't resolve the server names.
+func (c *Config) FromURL(u *url.URL, forward xproxy.Dialer) (xproxy.Dialer, error) {
+	switch u.Scheme {
+	case "http", "https":
+		return c.newHTTPProxy(u, forward)
+	case "socks4", "socks4a":
+		return newSOCKS4Proxy(u, forward)
+	}
+	d, err := xproxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "socks5" {
+		d = &resolvingDialer{d}
+	}
+	return d, nil
+}
+
+// HostPort returns the proxy host:port with the default port of the scheme, as the proxy dialers use.
+func HostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// ChainString returns the proxy chain as logged, DIRECT for the empty chain.
+func ChainString(chain []*url.URL) string {
+	if len(chain) == 0 {
+		return "DIRECT"
+	}
+	hops := make([]string, len(chain))
+	for i, u := range chain {
+		hops[i] = u.Redacted()
+	}
+	return strings.Join(hops, " -> ")
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// serveSOCKS5 serves a SOCKS5 proxy without authentication, sending the address type of every request to atyps.
+func serveSOCKS5(t *testing.T, atyps chan<- byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hdr := make([]byte, 2)
+				if _, err := io.ReadFull(conn, hdr); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				atyps <- req[3]
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestSOCKS5Resolution checks that the socks5:// proxies get the addresses resolved locally
+// and the socks5h:// proxies get the host names.
+func TestSOCKS5Resolution(t *testing.T) {
+	atyps := make(chan byte, 1)
+	addr := serveSOCKS5(t, atyps)
+	tests := []struct {
+		scheme string
+		atyp   byte
+	}{
+		{"socks5", 1},  // IPv4 address
+		{"socks5h", 3}, // domain name
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			d, err := (&Config{}).FromURL(&url.URL{Scheme: tt.scheme, Host: addr}, xproxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := d.Dial("tcp", "localhost:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if atyp := <-atyps; atyp != tt.atyp {
+				t.Errorf("address type %d, want %d", atyp, tt.atyp)
+			}
+		})
+	}
+
+	// The host names which don't resolve locally fail before the proxy.
+	d, err := (&Config{}).FromURL(&url.URL{Scheme: "socks5", Host: addr}, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial("tcp", "host.invalid:80"); err == nil {
+		t.Error("Dial(host.invalid) through socks5:// = nil, want a resolution error")
+	}
+}
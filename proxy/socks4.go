@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// resolvingDialer resolves the host names locally before dialing through the proxy.
+type resolvingDialer struct {
+	forward xproxy.Dialer
+}
+
+func (d *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	addr, err := resolveAddr(addr, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.forward.Dial(network, addr)
+}
+
+// resolveAddr resolves the host of the host:port address, preferring IPv4 or requiring it.
+func resolveAddr(addr string, ipv4Only bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ipv4Only && ip.To4() == nil {
+			return "", fmt.Errorf("%s is not an IPv4 address", host)
+		}
+		return addr, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return net.JoinHostPort(ip4.String(), port), nil
+		}
+	}
+	if ipv4Only || len(ips) == 0 {
+		return "", fmt.Errorf("no IPv4 address for %s", host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// SOCKS4 protocol constants
+const (
+	socks4Version   = 0x04
+	socks4Connect   = 0x01
+	socks4Granted   = 0x5a
+	socks4ReplySize = 8
+)
+
+type socks4Proxy struct {
+	host      string
+	userID    string
+	remoteDNS bool
+	forward   xproxy.Dialer
+}
+
+func newSOCKS4Proxy(uri *url.URL, forward xproxy.Dialer) (xproxy.Dialer, error) {
+	p := &socks4Proxy{
+		host:      uri.Host,
+		remoteDNS: uri.Scheme == "socks4a",
+		forward:   forward,
+	}
+	if uri.Port() == "" {
+		p.host = net.JoinHostPort(uri.Hostname(), "1080")
+	}
+	if uri.User != nil {
+		p.userID = uri.User.Username()
+	}
+	return p, nil
+}
+
+func (p *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("socks4: unsupported network %s", network)
+	}
+	if !p.remoteDNS {
+		var err error
+		if addr, err = resolveAddr(addr, true); err != nil {
+			return nil, err
+		}
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: invalid port %s", portStr)
+	}
+
+	req := []byte{socks4Version, socks4Connect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		// SOCKS4a: an invalid IP address 0.0.0.x tells the proxy to resolve the host name
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(req, ip...)
+	req = append(req, p.userID...)
+	req = append(req, 0)
+	if ip[0] == 0 {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := p.forward.Dial("tcp", p.host)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply [socks4ReplySize]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != 0 {
+		conn.Close()
+		return nil, errors.New("socks4: invalid reply version")
+	}
+	if reply[1] != socks4Granted {
+		conn.Close()
+		return nil, fmt.Errorf("socks4: connect %s rejected with code 0x%02x", addr, reply[1])
+	}
+	return conn, nil
+}
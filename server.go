@@ -1,18 +1,22 @@
 package main
 
 import (
-	"crypto/subtle"
+	"context"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
-	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/internal/netutil"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"github.com/metala/revwebsocks5/metrics"
+	"github.com/metala/revwebsocks5/server"
+	"github.com/metala/revwebsocks5/spy"
 	tls "github.com/refraction-networking/utls"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/websocket"
 )
 
 // serverCmd represents the server command
@@ -23,45 +27,144 @@ var serverCmd = &cobra.Command{
 client agents to establish a reverse tunnel.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if password == "" {
-			password = RandString(64)
-			log.Println("No password specified. Generated password is " + password)
+			password = tunnel.RandString(64)
+			slog.Info("No password specified. Generated password is " + password)
 		}
-		srv := server{
-			password:  []byte(password),
-			socksBind: socksBind,
-			socksPort: socksPort,
+		cfg := server.Config{
+			Password:        password,
+			TunnelPaths:     tunnelPaths,
+			SocksBind:       socksBind,
+			SocksPort:       socksPort,
+			SocketOwner:     socketOwner,
+			DNSBind:         dnsBind,
+			DNSPort:         dnsPort,
+			ForwardedHeader: trustedProxyHeader,
+			ShutdownTimeout: shutdownTimeout,
 		}
+		var err error
+		if cfg.TrustedProxies, err = server.ParseTrustedProxies(trustedProxies); err != nil {
+			fatal("Invalid trusted proxies", err)
+		}
+		if cfg.SocketMode, err = netutil.ParseMode(socketMode); err != nil {
+			fatal("Invalid socket mode", err)
+		}
+		if metricsListen != "" {
+			cfg.Metrics = metrics.NewRegistry()
+			if err := serveMetrics(metricsListen, cfg.Metrics); err != nil {
+				fatal("Failed to serve metrics", err)
+			}
+		}
+		if dnsPolicyFile != "" {
+			if cfg.DNSPolicy, err = server.LoadDNSPolicy(dnsPolicyFile); err != nil {
+				fatal("Failed to load the DNS policy", err)
+			}
+		}
+		if destPolicyFile != "" {
+			if cfg.DestPolicy, err = server.LoadDestPolicy(destPolicyFile); err != nil {
+				fatal("Failed to load the destination policy", err)
+			}
+		}
+		if auditLogFile != "" {
+			if cfg.Audit, err = audit.Open(auditLogFile, auditLogMaxSize<<20, auditLogMaxBackups); err != nil {
+				fatal("Failed to open the audit log", err)
+			}
+			defer cfg.Audit.Close()
+		}
+		if fallback != "" {
+			if cfg.Fallback, err = server.NewFallbackHandler(fallback); err != nil {
+				fatal("Invalid fallback", err)
+			}
+		}
+		if captureFile != "" {
+			if cfg.Capture, err = spy.OpenCapture(captureFile, captureStreams); err != nil {
+				fatal("Failed to open the capture", err)
+			}
+		}
+		activated, err := sdListeners()
+		if err != nil {
+			fatal("Failed to get the socket activated listeners", err)
+		}
+		ln, socksLns := splitSdListeners(activated)
+		cfg.SocksListeners = socksLns
+		var srv *server.Server
+		cfg.OnEvent = func(e server.Event) {
+			if e.Type != server.AgentConnected && e.Type != server.AgentDisconnected {
+				return
+			}
+			if err := sdNotify(fmt.Sprintf("STATUS=%d agents connected", len(srv.Agents()))); err != nil {
+				slog.Warn("Failed to notify systemd", "err", err)
+			}
+		}
+		if srv, err = server.New(cfg); err != nil {
+			fatal("Invalid server configuration", err)
+		}
+		ctx := cmd.Context()
 		wsSrv := &http.Server{
-			Handler:      srv.WsHandler(),
+			Handler:      srv,
 			Addr:         listen,
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 30 * time.Second,
-			ErrorLog:     log.Default(),
+			ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+			BaseContext:  func(net.Listener) context.Context { return ctx },
+		}
+		wsSrv.ConnState = func(c net.Conn, cs http.ConnState) {
+			slog.Debug("Connection state", "remote_addr", c.RemoteAddr().String(), "state", cs.String())
 		}
-		if debug {
-			wsSrv.ConnState = func(c net.Conn, cs http.ConnState) {
-				log.Printf("[%s] state: %s", c.RemoteAddr(), cs)
+		if ln != nil {
+			listen = ln.Addr().String()
+			slog.Info("Using socket activated listener", "listen", listen)
+		} else if ln, err = listenAddr(listen); err != nil {
+			fatal("Failed to listen", err)
+		}
+		if noTLS {
+			if !isLocalListener(ln) {
+				slog.Warn("Serving plain HTTP on a network address, the password and the tunnel are in clear text: "+
+					"listen on the loopback or a unix socket behind the reverse proxy", "listen", listen)
+			}
+			slog.Info("Listening for agents without TLS", "listen", listen)
+		} else {
+			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+			if err != nil {
+				fatal("Failed to load the TLS key pair", err)
+			}
+			tlsCfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				MaxVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{cert},
+				KeyLogWriter: tlsKeyLog,
 			}
+			slog.Info("Listening for agents using TLS", "listen", listen)
+			ln = tls.NewListener(ln, tlsCfg)
 		}
-		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
-		if err != nil {
-			log.Fatal(err)
+		if cfg.Capture != nil {
+			ln = cfg.Capture.Listener(ln)
+			wsSrv.ConnContext = spy.ConnContext
 		}
-		tlsCfg := &tls.Config{
-			MinVersion:   tls.VersionTLS12,
-			MaxVersion:   tls.VersionTLS13,
-			Certificates: []tls.Certificate{cert},
+		if err := sdNotify("READY=1\nSTATUS=0 agents connected"); err != nil {
+			slog.Warn("Failed to notify systemd", "err", err)
 		}
-
-		log.Printf("Listening for agents on %s using TLS", listen)
-		ln, err := net.Listen("tcp", listen)
-		if err != nil {
-			log.Fatal(err)
+		sdWatchdog()
+		go func() {
+			<-ctx.Done()
+			slog.Info("Shutting down, no longer accepting agents")
+			sdNotify("STOPPING=1")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			wsSrv.Shutdown(shutdownCtx)
+		}()
+		if err := wsSrv.Serve(ln); err != http.ErrServerClosed {
+			fatal("Failed to serve", err)
 		}
-		tlsLn := tls.NewListener(ln, tlsCfg)
-		if err := wsSrv.Serve(tlsLn); err != nil {
-			panic("ListenAndServe: " + err.Error())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout+2*tunnel.GoodbyeTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Timed out waiting for the agents to disconnect")
+			os.Exit(1)
 		}
+		if err := cfg.Capture.Close(); err != nil {
+			slog.Warn("Failed to write the capture", "err", err)
+		}
+		slog.Info("Server stopped")
 	},
 }
 
@@ -69,107 +172,38 @@ func init() {
 	rootCmd.AddCommand(serverCmd)
 
 	serverCmd.Flags().StringVarP(&listen, "listen", "l", "0.0.0.0:8443", "listen port for receiver address:port")
-	serverCmd.Flags().StringVarP(&socksBind, "socks-bind", "", "127.0.0.1", "socks5 bind address")
+	serverCmd.Flags().StringVarP(&socksBind, "socks-bind", "", "127.0.0.1", "socks5 bind address or unix:/path prefix")
 	serverCmd.Flags().Uint16VarP(&socksPort, "socks-port", "", 1080, "SOCKS5 starting port")
+	serverCmd.Flags().StringVarP(&dnsBind, "dns-bind", "", "127.0.0.1", "DNS bind address resolving through the agents")
+	serverCmd.Flags().Uint16VarP(&dnsPort, "dns-port", "", 0, "DNS starting port resolving through the agents (0 to disable)")
 	serverCmd.Flags().StringVarP(&connect, "connect", "c", "", "connect address:port")
 	serverCmd.Flags().StringSliceVarP(&proxies, "proxy", "", []string{}, "proxy address:port")
 	serverCmd.Flags().StringVarP(&password, "password", "P", "", "Connect password")
 	serverCmd.Flags().StringVarP(&userAgent, "user-agent", "", "", "User-Agent")
 	serverCmd.Flags().StringVarP(&tlsKey, "tls-key", "", "", "TLS key file")
 	serverCmd.Flags().StringVarP(&tlsCert, "tls-cert", "", "", "TLS certificate file")
+	serverCmd.Flags().StringSliceVarP(&tunnelPaths, "path", "", []string{}, "tunnel path (defaults to any path)")
+	serverCmd.Flags().StringVarP(&fallback, "fallback", "", "", "upstream URL or static directory serving non-tunnel requests")
 
-	serverCmd.MarkFlagsRequiredTogether("tls-key", "tls-cert")
-}
-
-type server struct {
-	password  []byte
-	socksBind string
-	socksPort uint16
-}
-
-func (s *server) agentHandler(conn *websocket.Conn) {
-	agentstr := conn.Request().RemoteAddr
-	log.Printf("[%s] Agent connected.", agentstr)
-	conn.SetReadDeadline(time.Now().Add(100 * time.Hour))
-
-	session, err := yamux.Client(conn, nil)
-	if err != nil {
-		log.Printf("[%s] Error creating client in yamux for %s: %v", agentstr, conn.RemoteAddr(), err)
-		return
-	}
-	s.listenForSocks5Clients(agentstr, session)
-}
-
-func (s *server) WsHandler() http.HandlerFunc {
-	wsAgentHandler := websocket.Handler(s.agentHandler)
-	return func(w http.ResponseWriter, r *http.Request) {
-		if debug {
-			log.Printf("[%s] New agent negotiation.", r.RemoteAddr)
-		}
-
-		authz := []byte(r.Header.Get("authorization"))
-		if subtle.ConstantTimeCompare(authz, s.password) == 0 {
-			if debug {
-				log.Printf("[%s] Error: Invalid password", r.RemoteAddr)
-			}
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-		wsAgentHandler.ServeHTTP(w, r)
-	}
-}
+	serverCmd.Flags().StringVarP(&dnsPolicyFile, "dns-policy", "", "", "JSON file choosing the server or agent DNS resolution per zone, with hosts overrides")
 
-func (s *server) listenForSocks5Clients(agentstr string, session *yamux.Session) error {
-	var ln net.Listener
-	var address string
-	var err error
+	serverCmd.Flags().StringVarP(&destPolicyFile, "dest-policy", "", "", "JSON file allowing or denying the SOCKS5 destinations per agent and user")
+	serverCmd.Flags().StringVarP(&metricsListen, "metrics-listen", "", "", "Prometheus /metrics listen address:port or unix:/path")
+	serverCmd.Flags().StringVarP(&tlsKeyLogFile, "tls-keylog", "", "", "file logging the TLS secrets for decrypting captures (defaults to SSLKEYLOGFILE)")
+	serverCmd.Flags().StringVarP(&captureFile, "capture", "", "", "pcapng file capturing the decrypted agent connections")
+	serverCmd.Flags().BoolVarP(&captureStreams, "capture-streams", "", false, "also capture the tunnelled streams as their own flows")
+	serverCmd.Flags().StringVarP(&auditLogFile, "audit-log", "", "", "JSON lines audit log of the SOCKS5 destinations")
+	serverCmd.Flags().Int64VarP(&auditLogMaxSize, "audit-log-max-size", "", 100, "audit log size in MB triggering the rotation (0 to disable)")
+	serverCmd.Flags().IntVarP(&auditLogMaxBackups, "audit-log-max-backups", "", 5, "rotated audit logs to keep")
 
-	port := s.socksPort
-	for {
-		address = fmt.Sprintf("%s:%d", s.socksBind, port)
-		log.Printf("[%s] Waiting for SOCKS5 clients on %s for %s", agentstr, address, agentstr)
-		ln, err = net.Listen("tcp", address)
-		if err != nil {
-			log.Printf("[%s] Error listening on %s: %v", agentstr, address, err)
-			port = port + 1
-		} else {
-			break
-		}
-	}
-	go func() {
-		<-session.CloseChan()
-		ln.Close()
-	}()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("[%s] Error accepting on %s: %v", agentstr, address, err)
-			return err
-		}
-		if session == nil {
-			log.Printf("[%s] Session on %s is nil", agentstr, address)
-			conn.Close()
-			continue
-		}
-		log.Printf("[%s] Got client. Opening stream for %s", agentstr, conn.RemoteAddr())
+	serverCmd.Flags().BoolVarP(&noTLS, "no-tls", "", false, "serve plain HTTP behind a TLS-terminating reverse proxy")
+	serverCmd.Flags().StringVarP(&socketMode, "socket-mode", "", "", "unix socket file mode (e.g. 0660)")
+	serverCmd.Flags().StringVarP(&socketOwner, "socket-owner", "", "", "unix socket owner as user[:group]")
+	serverCmd.Flags().StringSliceVarP(&trustedProxies, "trusted-proxy", "", []string{}, "trusted reverse proxy CIDR for the --trusted-proxy-header")
+	serverCmd.Flags().StringVarP(&trustedProxyHeader, "trusted-proxy-header", "", server.HeaderXForwardedFor, "header the trusted reverse proxies add the client address to (forwarded or x-forwarded-for)")
 
-		stream, err := session.Open()
-		if err != nil {
-			log.Printf("[%s] Error opening stream for %s: %v", agentstr, conn.RemoteAddr(), err)
-			return err
-		}
+	serverCmd.Flags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", 30*time.Second, "time to drain connections on shutdown")
 
-		// connect both of conn and stream
-		log.Printf("[%s] Forwarding connection for %s", agentstr, conn.RemoteAddr())
-		go func() {
-			io.Copy(conn, stream)
-			conn.Close()
-			log.Printf("[%s] Done forwarding conn to stream for %s", agentstr, conn.RemoteAddr())
-		}()
-		go func() {
-			io.Copy(stream, conn)
-			stream.Close()
-			log.Printf("[%s] Done forwarding stream to conn for %s", agentstr, conn.RemoteAddr())
-		}()
-	}
+	serverCmd.MarkFlagsRequiredTogether("tls-key", "tls-cert")
+	serverCmd.MarkFlagsMutuallyExclusive("no-tls", "tls-key")
 }
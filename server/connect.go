@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/internal/socks"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+// openConnect opens a connect stream to the destination of the request, in the compact form of the stream type,
+// the address type, the address and the port. The agent answers with the SOCKS5 reply code.
+// With approve, it opens a resolve stream: the agent first answers with a reply code and the address
+// it resolved the name to, and connects only if approve accepts the address. It returns the resolved address.
+func openConnect(session *yamux.Session, req *socks.Request, approve func(ip string) bool) (*yamux.Stream, byte, string, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, socks.GeneralFailure, "", err
+	}
+	t := tunnel.StreamConnect
+	if approve != nil {
+		t = tunnel.StreamResolve
+	}
+	var code [1]byte
+	var resolved string
+	if _, err = stream.Write(append([]byte{t}, req.AddrBytes()...)); err == nil {
+		_, err = io.ReadFull(stream, code[:])
+	}
+	if err == nil && approve != nil && code[0] == socks.Succeeded {
+		if resolved, err = readResolved(stream); err == nil {
+			if !approve(resolved) {
+				stream.Write([]byte{socks.NotAllowed})
+				stream.Close()
+				return nil, socks.NotAllowed, resolved, nil
+			}
+			if _, err = stream.Write([]byte{socks.Succeeded}); err == nil {
+				_, err = io.ReadFull(stream, code[:])
+			}
+		}
+	}
+	if err != nil {
+		stream.Close()
+		return nil, socks.GeneralFailure, resolved, err
+	}
+	return stream, code[0], resolved, nil
+}
+
+// readResolved reads the address type, the address and the port of the resolved destination.
+func readResolved(r io.Reader) (string, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", err
+	}
+	addr, err := socks.ReadAddr(r, socks.Connect, addrType[0])
+	if err != nil {
+		return "", err
+	}
+	if addr.IsDomain() {
+		return "", fmt.Errorf("unresolved destination %s", addr)
+	}
+	return addr.Host, nil
+}
+
+// replaySocks opens a SOCKS5 stream and replays the greeting and the request to the agent, as the agents
+// without the connect streams understand. It skips the method selection of the agent and returns its reply.
+func replaySocks(session *yamux.Session, req *socks.Request) (*yamux.Stream, *socks.Request, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	var method [2]byte
+	var reply *socks.Request
+	if _, err = stream.Write(append([]byte{socks.Version, 1, socks.NoAuth}, req.Bytes()...)); err == nil {
+		if _, err = io.ReadFull(stream, method[:]); err == nil {
+			reply, err = socks.ReadRequest(stream)
+		}
+	}
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	return stream, reply, nil
+}
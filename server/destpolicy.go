@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DestPolicy allows or denies the SOCKS5 destinations on the server, before they reach the agent.
+// The global rules, the rules of the agent, keyed by the agent IP address, and the rules of the SOCKS user
+// all apply. With users, the SOCKS clients authenticate with their username and password.
+type DestPolicy struct {
+	destRules
+	Agents map[string]*destRules `json:"agents"`
+	Users  map[string]*destUser  `json:"users"`
+}
+
+type destUser struct {
+	destRules
+	Password string `json:"password"`
+}
+
+// destRules denies the destinations matching a deny rule and, if there are allow rules, the ones matching none.
+// A rule is [host][:ports], where the host is an IP address, a CIDR, a domain zone matching its subdomains too,
+// or * for any, and the ports are a port or a range like 8000-8999. IPv6 addresses with ports go in brackets.
+type destRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow []*destRule
+	deny  []*destRule
+}
+
+type destRule struct {
+	ipNet   *net.IPNet
+	zone    string
+	minPort uint16
+	maxPort uint16
+}
+
+// LoadDestPolicy loads the destination policy from the JSON file.
+func LoadDestPolicy(filename string) (*DestPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p DestPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if err := p.init(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for agent, rules := range p.Agents {
+		if err := rules.init(); err != nil {
+			return nil, fmt.Errorf("%s: agent %s: %w", filename, agent, err)
+		}
+	}
+	for user, u := range p.Users {
+		if err := u.init(); err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", filename, user, err)
+		}
+	}
+	return &p, nil
+}
+
+// init parses the rules.
+func (r *destRules) init() error {
+	for _, s := range r.Allow {
+		rule, err := parseDestRule(s)
+		if err != nil {
+			return err
+		}
+		r.allow = append(r.allow, rule)
+	}
+	for _, s := range r.Deny {
+		rule, err := parseDestRule(s)
+		if err != nil {
+			return err
+		}
+		r.deny = append(r.deny, rule)
+	}
+	return nil
+}
+
+func parseDestRule(s string) (*destRule, error) {
+	host, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid rule '%s'", s)
+		}
+		host, ports = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	} else if strings.Count(s, ":") == 1 {
+		host, ports, _ = strings.Cut(s, ":")
+	}
+
+	rule := &destRule{maxPort: 65535}
+	switch {
+	case host == "" || host == "*":
+	case strings.Contains(host, "/"):
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %w", s, err)
+		}
+		rule.ipNet = ipNet
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		rule.zone = normalizeName(host)
+	}
+
+	if ports != "" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			hi = lo
+		}
+		minPort, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': invalid port '%s'", s, lo)
+		}
+		maxPort, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || maxPort < minPort {
+			return nil, fmt.Errorf("invalid rule '%s': invalid port '%s'", s, hi)
+		}
+		rule.minPort, rule.maxPort = uint16(minPort), uint16(maxPort)
+	}
+	return rule, nil
+}
+
+// match reports whether the rule matches any of the hosts, a name or an IP address, and the port.
+func (rule *destRule) match(hosts []string, port uint16) bool {
+	if port < rule.minPort || port > rule.maxPort {
+		return false
+	}
+	if rule.ipNet == nil && rule.zone == "" {
+		return true
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if rule.ipNet != nil && rule.ipNet.Contains(ip) {
+				return true
+			}
+		} else if rule.zone != "" && zoneMatch(normalizeName(host), rule.zone) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *destRules) allowed(hosts []string, port uint16) bool {
+	if r == nil {
+		return true
+	}
+	for _, rule := range r.deny {
+		if rule.match(hosts, port) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, rule := range r.allow {
+		if rule.match(hosts, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the agent and the user may reach the port of the hosts, the requested name
+// and its address, resolved by the server or reported by the agent.
+func (p *DestPolicy) allowed(agent, user string, hosts []string, port uint16) bool {
+	if p == nil {
+		return true
+	}
+	if !p.destRules.allowed(hosts, port) || !p.Agents[agentIP(agent)].allowed(hosts, port) {
+		return false
+	}
+	if u := p.Users[user]; u != nil {
+		return u.allowed(hosts, port)
+	}
+	return true
+}
+
+// needsIP reports whether the rules of the agent or the user match IP addresses, so that the names
+// must be checked with the address they resolve to.
+func (p *DestPolicy) needsIP(agent, user string) bool {
+	if p == nil {
+		return false
+	}
+	if p.destRules.hasIPRules() || p.Agents[agentIP(agent)].hasIPRules() {
+		return true
+	}
+	u := p.Users[user]
+	return u != nil && u.hasIPRules()
+}
+
+func (r *destRules) hasIPRules() bool {
+	if r == nil {
+		return false
+	}
+	for _, rule := range r.allow {
+		if rule.ipNet != nil {
+			return true
+		}
+	}
+	for _, rule := range r.deny {
+		if rule.ipNet != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// auth returns the SOCKS5 credentials check of the users, or nil without users.
+func (p *DestPolicy) auth() func(user, password string) bool {
+	if p == nil || len(p.Users) == 0 {
+		return nil
+	}
+	return func(user, password string) bool {
+		u, ok := p.Users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+	}
+}
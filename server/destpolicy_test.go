@@ -0,0 +1,171 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadDestPolicy(t *testing.T, policy string) (*DestPolicy, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(file, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadDestPolicy(file)
+}
+
+func TestLoadDestPolicyErrors(t *testing.T) {
+	for _, policy := range []string{
+		`{"deny": [`,
+		`{"deny": ["10.0.0.0/33"]}`,
+		`{"allow": ["[2001:db8::1"]}`,
+		`{"allow": [":http"]}`,
+		`{"allow": [":99999"]}`,
+		`{"allow": [":443-80"]}`,
+		`{"allow": [":80-x"]}`,
+		`{"agents": {"203.0.113.7": {"deny": ["10.0.0.0/99"]}}}`,
+		`{"users": {"alice": {"password": "secret", "allow": [":0-"]}}}`,
+	} {
+		if _, err := loadDestPolicy(t, policy); err == nil {
+			t.Errorf("LoadDestPolicy(%s) = nil error, want an error", policy)
+		}
+	}
+}
+
+func TestParseDestRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		hosts []string
+		port  uint16
+		want  bool
+	}{
+		{"*", []string{"example.com"}, 80, true},
+		{":443", []string{"example.com"}, 443, true},
+		{":443", []string{"example.com"}, 80, false},
+		{"*:8000-8999", []string{"10.0.0.1"}, 8999, true},
+		{"*:8000-8999", []string{"10.0.0.1"}, 9000, false},
+		{"10.0.0.0/8", []string{"10.1.2.3"}, 80, true},
+		{"10.0.0.0/8", []string{"11.1.2.3"}, 80, false},
+		{"10.0.0.0/8", []string{"internal.example.com"}, 80, false},
+		{"10.1.2.3:22", []string{"10.1.2.3"}, 22, true},
+		{"10.1.2.3:22", []string{"10.1.2.4"}, 22, false},
+		{"2001:db8::1", []string{"2001:db8::1"}, 443, true},
+		{"[2001:db8::/32]:443", []string{"2001:db8::5"}, 443, true},
+		{"[2001:db8::/32]:443", []string{"2001:db8::5"}, 80, false},
+		{"corp.internal", []string{"corp.internal"}, 80, true},
+		{"corp.internal", []string{"Wiki.Corp.Internal."}, 80, true},
+		{"corp.internal", []string{"notcorp.internal"}, 80, false},
+		{"corp.internal", []string{"10.0.0.1"}, 80, false},
+		{"corp.internal:443", []string{"wiki.corp.internal", "10.0.0.1"}, 443, true},
+		{"10.0.0.0/8", []string{"wiki.corp.internal", "10.0.0.1"}, 443, true},
+	}
+	for _, tt := range tests {
+		rule, err := parseDestRule(tt.rule)
+		if err != nil {
+			t.Fatalf("parseDestRule(%s) = %v", tt.rule, err)
+		}
+		if got := rule.match(tt.hosts, tt.port); got != tt.want {
+			t.Errorf("rule %s matches %v port %d = %t, want %t", tt.rule, tt.hosts, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestDestPolicyAllowed(t *testing.T) {
+	p, err := loadDestPolicy(t, `{
+		"allow": ["10.0.0.0/8", "corp.internal"],
+		"deny": [":25", "10.0.0.0/24"],
+		"agents": {"203.0.113.7": {"deny": ["db.corp.internal"]}},
+		"users": {"alice": {"password": "secret", "allow": [":443", ":22"]}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		agent string
+		user  string
+		hosts []string
+		port  uint16
+		want  bool
+	}{
+		{"allowed CIDR", "198.51.100.1:4000", "", []string{"10.1.0.1"}, 80, true},
+		{"allowed zone", "198.51.100.1:4000", "", []string{"wiki.corp.internal"}, 80, true},
+		{"default deny with allow rules", "198.51.100.1:4000", "", []string{"example.com"}, 80, false},
+		{"deny wins over a matching allow", "198.51.100.1:4000", "", []string{"10.0.0.5"}, 80, false},
+		{"denied port of an allowed host", "198.51.100.1:4000", "", []string{"10.1.0.1"}, 25, false},
+		{"agent deny", "203.0.113.7:4000", "", []string{"db.corp.internal"}, 80, false},
+		{"agent deny scoped to the agent", "198.51.100.1:4000", "", []string{"db.corp.internal"}, 80, true},
+		{"agent deny on the agent address only", "203.0.113.7:4000", "", []string{"wiki.corp.internal"}, 80, true},
+		{"user allow", "198.51.100.1:4000", "alice", []string{"wiki.corp.internal"}, 443, true},
+		{"user allow restricts the global allow", "198.51.100.1:4000", "alice", []string{"wiki.corp.internal"}, 80, false},
+		{"user allow doesn't widen the global allow", "198.51.100.1:4000", "alice", []string{"example.com"}, 443, false},
+		{"unknown user gets the global rules", "198.51.100.1:4000", "bob", []string{"wiki.corp.internal"}, 80, true},
+		{"name allowed, resolved address denied", "198.51.100.1:4000", "", []string{"wiki.corp.internal", "10.0.0.5"}, 80, false},
+		{"name not allowed, resolved address allowed", "198.51.100.1:4000", "", []string{"example.com", "10.1.0.1"}, 80, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.allowed(tt.agent, tt.user, tt.hosts, tt.port); got != tt.want {
+				t.Errorf("allowed(%s, %s, %v, %d) = %t, want %t", tt.agent, tt.user, tt.hosts, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestPolicyDefaults(t *testing.T) {
+	var nilPolicy *DestPolicy
+	if !nilPolicy.allowed("198.51.100.1:4000", "", []string{"example.com"}, 80) {
+		t.Error("nil policy denies, want everything allowed")
+	}
+	p, err := loadDestPolicy(t, `{"deny": ["example.com"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.allowed("198.51.100.1:4000", "", []string{"example.org"}, 80) {
+		t.Error("deny only policy denies another host, want it allowed")
+	}
+	if p.allowed("198.51.100.1:4000", "", []string{"www.example.com"}, 80) {
+		t.Error("deny only policy allows a denied host")
+	}
+}
+
+func TestDestPolicyNeedsIP(t *testing.T) {
+	tests := []struct {
+		policy string
+		agent  string
+		user   string
+		want   bool
+	}{
+		{`{"deny": ["corp.internal", ":25"]}`, "198.51.100.1:4000", "", false},
+		{`{"deny": ["10.0.0.0/8"]}`, "198.51.100.1:4000", "", true},
+		{`{"allow": ["10.1.2.3"]}`, "198.51.100.1:4000", "", true},
+		{`{"agents": {"203.0.113.7": {"deny": ["10.0.0.0/8"]}}}`, "203.0.113.7:4000", "", true},
+		{`{"agents": {"203.0.113.7": {"deny": ["10.0.0.0/8"]}}}`, "198.51.100.1:4000", "", false},
+		{`{"users": {"alice": {"password": "secret", "deny": ["10.0.0.0/8"]}}}`, "198.51.100.1:4000", "alice", true},
+		{`{"users": {"alice": {"password": "secret", "deny": ["10.0.0.0/8"]}}}`, "198.51.100.1:4000", "bob", false},
+	}
+	for _, tt := range tests {
+		p, err := loadDestPolicy(t, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.needsIP(tt.agent, tt.user); got != tt.want {
+			t.Errorf("needsIP(%s, %s) of %s = %t, want %t", tt.agent, tt.user, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestDestPolicyAuth(t *testing.T) {
+	p, err := loadDestPolicy(t, `{"users": {"alice": {"password": "secret"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := p.auth()
+	if auth == nil || !auth("alice", "secret") || auth("alice", "wrong") || auth("bob", "secret") {
+		t.Error("auth() doesn't check the users' passwords")
+	}
+	if (&DestPolicy{}).auth() != nil {
+		t.Error("auth() without users is not nil")
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTimeout is the timeout of the DNS exchanges with the agent and of the idle DNS over TCP clients.
+const dnsTimeout = 10 * time.Second
+
+// serveDNS serves DNS queries over UDP and TCP on the first free DNS port and resolves them through the agent,
+// until the session is closed or ctx is done. It gives up on the other errors than the port in use.
+func (s *Server) serveDNS(ctx context.Context, a *Agent) {
+	var ln net.Listener
+	var pc net.PacketConn
+	var address string
+	for port := s.cfg.DNSPort; ln == nil; port++ {
+		address = net.JoinHostPort(s.cfg.DNSBind, strconv.Itoa(int(port)))
+		var err error
+		if ln, err = net.Listen("tcp", address); err == nil {
+			if pc, err = net.ListenPacket("udp", address); err != nil {
+				ln.Close()
+				ln = nil
+			}
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || port == math.MaxUint16 {
+			a.log.Error("Failed to listen for DNS", "listen", address, "err", err)
+			return
+		}
+		a.log.Warn("Error listening for DNS", "listen", address, "err", err)
+	}
+	a.log.Info("Resolving DNS queries through the agent", "listen", address)
+	s.emit(DNSListening, a, address)
+	go func() {
+		select {
+		case <-a.session.CloseChan():
+		case <-ctx.Done():
+		}
+		ln.Close()
+		pc.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveDNSConn(conn, a.session)
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			answer, err := exchangeDNS(a.session, query)
+			if err != nil {
+				a.log.Debug("Error resolving DNS query", "client_addr", addr.String(), "err", err)
+				return
+			}
+			pc.WriteTo(truncateDNS(query, answer), addr)
+		}()
+	}
+}
+
+// truncateDNS truncates the UDP answer larger than the payload size of the query, 512 bytes without EDNS,
+// to its header and question with the TC flag, for the client to retry over TCP.
+func truncateDNS(query, answer []byte) []byte {
+	size := 512
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err == nil {
+		for _, rr := range q.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) > size {
+				size = int(rr.Header.Class)
+			}
+		}
+	}
+	if len(answer) <= size {
+		return answer
+	}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(answer)
+	if err != nil {
+		return answer
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return answer
+	}
+	hdr.Truncated = true
+	truncated, err := (&dnsmessage.Message{Header: hdr, Questions: questions}).Pack()
+	if err != nil {
+		return answer
+	}
+	return truncated
+}
+
+// serveDNSConn serves the DNS over TCP client.
+func serveDNSConn(conn net.Conn, session *yamux.Session) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTimeout))
+		query, err := tunnel.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		answer, err := exchangeDNS(session, query)
+		if err != nil {
+			return
+		}
+		if err := tunnel.WriteDNSMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// exchangeDNS sends the query to the agent through a new stream and returns the answer.
+func exchangeDNS(session *yamux.Session, query []byte) ([]byte, error) {
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := stream.Write([]byte{tunnel.StreamDNS}); err != nil {
+		return nil, err
+	}
+	if err := tunnel.WriteDNSMessage(stream, query); err != nil {
+		return nil, err
+	}
+	return tunnel.ReadDNSMessage(stream)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTruncateDNS(t *testing.T) {
+	name := dnsmessage.MustNewName("big.test.")
+	question := dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}
+	pack := func(msg dnsmessage.Message) []byte {
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var opt dnsmessage.Resource
+	if err := opt.Header.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	opt.Body = &dnsmessage.OPTResource{}
+	plain := pack(dnsmessage.Message{Header: dnsmessage.Header{ID: 1}, Questions: []dnsmessage.Question{question}})
+	edns := pack(dnsmessage.Message{Header: dnsmessage.Header{ID: 1}, Questions: []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{opt}})
+
+	answer := dnsmessage.Message{Header: dnsmessage.Header{ID: 1, Response: true}, Questions: []dnsmessage.Question{question}}
+	for i := 0; i < 4; i++ {
+		answer.Answers = append(answer.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.TXTResource{TXT: []string{string(make([]byte, 200))}},
+		})
+	}
+	large := pack(answer)
+	answer.Answers = answer.Answers[:1]
+	small := pack(answer)
+
+	tests := []struct {
+		name      string
+		query     []byte
+		answer    []byte
+		truncated bool
+	}{
+		{"small answer", plain, small, false},
+		{"large answer without EDNS", plain, large, true},
+		{"large answer with EDNS", edns, large, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg dnsmessage.Message
+			if err := msg.Unpack(truncateDNS(tt.query, tt.answer)); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Truncated != tt.truncated {
+				t.Errorf("TC = %v, want %v", msg.Truncated, tt.truncated)
+			}
+			if tt.truncated && (len(msg.Answers) != 0 || len(msg.Questions) != 1) {
+				t.Errorf("truncated to %d questions and %d answers, want the question only", len(msg.Questions), len(msg.Answers))
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/metala/revwebsocks5/internal/socks"
+)
+
+const (
+	dnsRemote = "remote"
+	dnsLocal  = "local"
+)
+
+// DNSPolicy chooses where the SOCKS5 domain requests are resolved: by the agent (remote) or by the server (local).
+// The longest matching zone suffix wins, otherwise the default applies. The hosts override the names,
+// with an IP address or another name, like a hosts file. The agents sections, keyed by the agent IP address,
+// add their zones and override the hosts and the default. The hosts apply once validated by LoadDNSPolicy.
+type DNSPolicy struct {
+	Default     string                `json:"default"`
+	LocalZones  []string              `json:"local-zones"`
+	RemoteZones []string              `json:"remote-zones"`
+	Hosts       map[string]string     `json:"hosts"`
+	Agents      map[string]*DNSPolicy `json:"agents"`
+
+	hosts map[string]string // by normalized name
+}
+
+// LoadDNSPolicy loads the DNS policy from the JSON file.
+func LoadDNSPolicy(filename string) (*DNSPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p DNSPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if err := p.init(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for agent, ap := range p.Agents {
+		if err := ap.init(); err != nil {
+			return nil, fmt.Errorf("%s: agent %s: %w", filename, agent, err)
+		}
+	}
+	return &p, nil
+}
+
+// init validates the policy and sets the hosts by normalized name.
+func (p *DNSPolicy) init() error {
+	switch p.Default {
+	case "", dnsRemote, dnsLocal:
+	default:
+		return fmt.Errorf("invalid default '%s', expected %s or %s", p.Default, dnsRemote, dnsLocal)
+	}
+	p.hosts = make(map[string]string, len(p.Hosts))
+	for name, target := range p.Hosts {
+		if len(target) > socks.MaxHostLen {
+			return fmt.Errorf("host %s: target longer than %d bytes", name, socks.MaxHostLen)
+		}
+		p.hosts[normalizeName(name)] = target
+	}
+	return nil
+}
+
+// forAgent returns the policy for the agent address, with its own section merged in.
+func (p *DNSPolicy) forAgent(agent string) *DNSPolicy {
+	if p == nil {
+		return nil
+	}
+	ap, ok := p.Agents[agentIP(agent)]
+	if !ok {
+		return p
+	}
+	merged := &DNSPolicy{
+		Default:     p.Default,
+		LocalZones:  append(append([]string{}, ap.LocalZones...), p.LocalZones...),
+		RemoteZones: append(append([]string{}, ap.RemoteZones...), p.RemoteZones...),
+		hosts:       make(map[string]string),
+	}
+	if ap.Default != "" {
+		merged.Default = ap.Default
+	}
+	for name, target := range p.hosts {
+		merged.hosts[name] = target
+	}
+	for name, target := range ap.hosts {
+		merged.hosts[name] = target
+	}
+	return merged
+}
+
+// resolveLocally reports whether the name is resolved by the server.
+func (p *DNSPolicy) resolveLocally(name string) bool {
+	name = normalizeName(name)
+	best, local := -1, p.Default == dnsLocal
+	for _, z := range p.LocalZones {
+		if n := zoneMatch(name, z); n > best {
+			best, local = n, true
+		}
+	}
+	for _, z := range p.RemoteZones {
+		if n := zoneMatch(name, z); n > best {
+			best, local = n, false
+		}
+	}
+	return local
+}
+
+// zoneMatch returns the length of the zone if the name is in it, or -1.
+// The root zone "." matches any name.
+func zoneMatch(name, zone string) int {
+	zone = normalizeName(zone)
+	if zone == "" || name == zone || strings.HasSuffix(name, "."+zone) {
+		return len(zone)
+	}
+	return -1
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// rewrite applies the hosts overrides to the request and resolves the name on the server if the policy says so.
+func (p *DNSPolicy) rewrite(ctx context.Context, req *socks.Request) error {
+	if p == nil || !req.IsDomain() {
+		return nil
+	}
+	if target, ok := p.hosts[normalizeName(req.Host)]; ok {
+		req.Host = target
+		if !req.IsDomain() {
+			return nil
+		}
+	}
+	if !p.resolveLocally(req.Host) {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, req.Host)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			req.Host = a.IP.String()
+			return nil
+		}
+	}
+	req.Host = addrs[0].IP.String()
+	return nil
+}
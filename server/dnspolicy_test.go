@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/metala/revwebsocks5/internal/socks"
+)
+
+func TestLoadDNSPolicyLongTarget(t *testing.T) {
+	long := strings.Repeat("a", socks.MaxHostLen+1)
+	for _, policy := range []string{
+		fmt.Sprintf(`{"hosts": {"db.internal": %q}}`, long),
+		fmt.Sprintf(`{"agents": {"10.0.0.1": {"hosts": {"db.internal": %q}}}}`, long),
+	} {
+		file := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(file, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDNSPolicy(file); err == nil {
+			t.Errorf("LoadDNSPolicy(%.40s...) = nil error, want the long target rejected", policy)
+		}
+	}
+}
+
+func TestDNSPolicyRewrite(t *testing.T) {
+	p := &DNSPolicy{
+		Hosts: map[string]string{
+			"DB.internal":  "10.0.0.5",
+			"web.internal": "web.example.com",
+		},
+		Agents: map[string]*DNSPolicy{
+			"10.0.0.1": {Hosts: map[string]string{"web.internal": "10.0.0.6"}},
+		},
+	}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Agents["10.0.0.1"].init(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		agent string
+		host  string
+		want  string
+	}{
+		{"10.0.0.2:1234", "db.internal.", "10.0.0.5"},
+		{"10.0.0.2:1234", "web.internal", "web.example.com"},
+		{"10.0.0.2:1234", "other.internal", "other.internal"},
+		{"10.0.0.1:1234", "web.internal", "10.0.0.6"},
+		{"10.0.0.1:1234", "db.internal", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		req := &socks.Request{Cmd: socks.Connect, Host: tt.host, Port: 80}
+		err := p.forAgent(tt.agent).rewrite(context.Background(), req)
+		if err != nil || req.Host != tt.want {
+			t.Errorf("rewrite(%s) for %s = %s, %v, want %s", tt.host, tt.agent, req.Host, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// NewFallbackHandler creates the handler serving requests that are not tunnel requests.
+// The target is either an upstream http(s):// URL, which is reverse proxied, or a static directory.
+func NewFallbackHandler(target string) (http.Handler, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("fallback URL '%s' has no host", target)
+		}
+		return httputil.NewSingleHostReverseProxy(u), nil
+	}
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("fallback '%s' is not a directory", target)
+	}
+	return http.FileServer(http.Dir(target)), nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The headers of the trusted proxies with the peer address.
+const (
+	HeaderForwarded     = "forwarded"
+	HeaderXForwardedFor = "x-forwarded-for"
+)
+
+// ParseTrustedProxies parses a list of CIDRs or IP addresses of the trusted reverse proxies.
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (s *Server) isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the peer, as reported by the trusted reverse proxies, if any.
+// The forwarded addresses of the ForwardedHeader are walked from the nearest hop, added by the trusted proxy,
+// and the first untrusted one is returned.
+// Peers on a unix socket are local, hence always trusted.
+func (s *Server) remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil && !s.isTrustedProxy(host) {
+		return r.RemoteAddr
+	}
+
+	hops := forwardedFor(r.Header, s.cfg.ForwardedHeader)
+	for i := len(hops) - 1; i >= 0; i-- {
+		host, port, err := net.SplitHostPort(hops[i])
+		if err != nil {
+			host, port = strings.Trim(hops[i], "[]"), ""
+		}
+		if net.ParseIP(host) == nil {
+			break
+		}
+		if i > 0 && s.isTrustedProxy(host) {
+			continue
+		}
+		if port == "" {
+			return host
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor returns the client addresses from the Forwarded or the X-Forwarded-For header.
+func forwardedFor(h http.Header, header string) []string {
+	var hops []string
+	if header == HeaderForwarded {
+		for _, v := range h.Values("Forwarded") {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hops = append(hops, strings.Trim(v, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
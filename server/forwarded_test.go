@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		forwarded  string
+		xff        string
+		want       string
+	}{
+		{"x-forwarded-for ignores forwarded", HeaderXForwardedFor, "127.0.0.1:5000", "for=198.51.100.9", "203.0.113.7", "203.0.113.7"},
+		{"forwarded ignores x-forwarded-for", HeaderForwarded, "127.0.0.1:5000", "for=203.0.113.7", "198.51.100.9", "203.0.113.7"},
+		{"x-forwarded-for only, forwarded configured", HeaderForwarded, "127.0.0.1:5000", "", "198.51.100.9", "127.0.0.1:5000"},
+		{"forwarded only, x-forwarded-for configured", HeaderXForwardedFor, "127.0.0.1:5000", "for=198.51.100.9", "", "127.0.0.1:5000"},
+		{"spoofed hop before the trusted proxy one", HeaderXForwardedFor, "127.0.0.1:5000", "", "198.51.100.9, 203.0.113.7", "203.0.113.7"},
+		{"trusted proxies chain", HeaderXForwardedFor, "127.0.0.1:5000", "", "203.0.113.7, 10.1.2.3", "203.0.113.7"},
+		{"forwarded with port", HeaderForwarded, "127.0.0.1:5000", `for="[2001:db8::1]:4711";proto=https`, "", "[2001:db8::1]:4711"},
+		{"untrusted peer", HeaderXForwardedFor, "192.0.2.1:5000", "", "203.0.113.7", "192.0.2.1:5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Config{
+				Password:        "secret",
+				TrustedProxies:  trusted,
+				ForwardedHeader: tt.header,
+				Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("Forwarded", tt.forwarded)
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := s.remoteAddr(r); got != tt.want {
+				t.Errorf("remoteAddr() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := New(Config{Password: "secret", ForwardedHeader: "x-real-ip"}); err == nil {
+		t.Error("New() with the x-real-ip header = nil error, want an error")
+	}
+}
@@ -0,0 +1,611 @@
+// Package server implements the server, which accepts the agents over WebSocket and forwards
+// the SOCKS5 clients to them.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/internal/netutil"
+	"github.com/metala/revwebsocks5/internal/socks"
+	"github.com/metala/revwebsocks5/internal/tunnel"
+	"github.com/metala/revwebsocks5/metrics"
+	"github.com/metala/revwebsocks5/spy"
+	"golang.org/x/net/websocket"
+)
+
+// Config configures the server. The zero values of the bind addresses, SocksPort and ShutdownTimeout
+// get the defaults of the command line.
+type Config struct {
+	Password       string
+	TunnelPaths    []string     // any path if empty
+	Fallback       http.Handler // serves the requests other than WebSocket upgrades on the tunnel paths, if set
+	TrustedProxies []*net.IPNet
+	// ForwardedHeader is the header the trusted proxies add the peer address to,
+	// HeaderXForwardedFor if empty. The other one is ignored, as the peer may send it.
+	ForwardedHeader string
+
+	// SocksBind is the SOCKS5 bind address or unix:/path prefix. Every agent gets the first free port
+	// from SocksPort, unless one of the SocksListeners is free, which are reused by the agents in turn.
+	SocksBind      string
+	SocksPort      uint16
+	SocksListeners []net.Listener
+	SocketMode     fs.FileMode
+	SocketOwner    string
+
+	DNSBind string
+	DNSPort uint16 // 0 to disable
+
+	DNSPolicy  *DNSPolicy
+	DestPolicy *DestPolicy
+	Audit      *audit.Log
+	Capture    *spy.Capture
+	Metrics    *metrics.Registry // of the server only if nil
+
+	ShutdownTimeout time.Duration
+	Logger          *slog.Logger
+	OnEvent         func(Event)
+}
+
+// EventType is the type of the events of the agents.
+type EventType int
+
+const (
+	AgentConnected EventType = iota
+	SocksListening
+	DNSListening
+	AgentDisconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case AgentConnected:
+		return "agent-connected"
+	case SocksListening:
+		return "socks-listening"
+	case DNSListening:
+		return "dns-listening"
+	case AgentDisconnected:
+		return "agent-disconnected"
+	}
+	return fmt.Sprintf("event-%d", int(t))
+}
+
+// Event is sent to Config.OnEvent. Addr is the listen address of the SocksListening and DNSListening events.
+type Event struct {
+	Type  EventType
+	Agent *Agent
+	Addr  string
+}
+
+// Server is the http.Handler accepting the agents.
+type Server struct {
+	cfg            Config
+	log            *slog.Logger
+	wsHandler      websocket.Handler
+	socksListeners chan net.Listener
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	closing  bool
+	agents   map[*Agent]struct{}
+	agentsWg sync.WaitGroup
+}
+
+// Agent is a connected agent with its tunnel session.
+type Agent struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	session *yamux.Session
+	log     *slog.Logger
+	cancel  context.CancelFunc
+}
+
+// Close disconnects the agent, after draining its connections and saying goodbye.
+func (a *Agent) Close() {
+	a.cancel()
+}
+
+// New returns the server of the configuration.
+func New(cfg Config) (*Server, error) {
+	if cfg.Password == "" {
+		return nil, errors.New("no password")
+	}
+	switch cfg.ForwardedHeader {
+	case "":
+		cfg.ForwardedHeader = HeaderXForwardedFor
+	case HeaderForwarded, HeaderXForwardedFor:
+	default:
+		return nil, fmt.Errorf("invalid forwarded header '%s', expected %s or %s", cfg.ForwardedHeader, HeaderForwarded, HeaderXForwardedFor)
+	}
+	if cfg.SocksBind == "" {
+		cfg.SocksBind = "127.0.0.1"
+	}
+	if cfg.SocksPort == 0 {
+		cfg.SocksPort = 1080
+	}
+	if cfg.DNSBind == "" {
+		cfg.DNSBind = "127.0.0.1"
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewRegistry()
+	}
+	s := &Server{
+		cfg:            cfg,
+		log:            cfg.Logger,
+		socksListeners: make(chan net.Listener, len(cfg.SocksListeners)),
+		agents:         make(map[*Agent]struct{}),
+	}
+	s.wsHandler = websocket.Handler(s.agentHandler)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, l := range cfg.SocksListeners {
+		s.socksListeners <- reusedListener{l}
+	}
+	return s, nil
+}
+
+// Agents returns the connected agents.
+func (s *Server) Agents() []*Agent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	agents := make([]*Agent, 0, len(s.agents))
+	for a := range s.agents {
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+// Shutdown disconnects the agents, after draining their connections and saying goodbye,
+// and waits for them until ctx is done. The server doesn't accept agents anymore.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.agentsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) emit(t EventType, a *Agent, addr string) {
+	if s.cfg.OnEvent != nil {
+		s.cfg.OnEvent(Event{Type: t, Agent: a, Addr: addr})
+	}
+}
+
+func (s *Server) agentHandler(conn *websocket.Conn) {
+	ctx, cancel := context.WithCancel(conn.Request().Context())
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+
+	a := &Agent{ID: tunnel.RandString(8), RemoteAddr: conn.Request().RemoteAddr, ConnectedAt: time.Now(), cancel: cancel}
+	a.log = s.log.With("agent_id", a.ID, "remote_addr", a.RemoteAddr)
+	a.log.Info("Agent connected")
+	spy.AnnotateConn(conn.Request().Context(), "agent_id="+a.ID+" remote_addr="+a.RemoteAddr)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Hour))
+
+	var err error
+	local, _ := conn.Request().Context().Value(http.LocalAddrContextKey).(net.Addr)
+	localAddr := ""
+	if local != nil {
+		localAddr = local.String()
+	}
+	a.session, err = yamux.Client(s.cfg.Capture.Mux(conn, localAddr, a.RemoteAddr, "agent_id="+a.ID), nil)
+	if err != nil {
+		a.log.Error("Error creating the yamux session", "err", err)
+		return
+	}
+	if !s.addAgent(a) {
+		a.log.Info("Refusing the agent, shutting down")
+		a.session.Close()
+		return
+	}
+	defer s.removeAgent(a)
+	go s.cfg.Metrics.PingSession(a.session, a.RemoteAddr)
+	if s.cfg.DNSPort != 0 {
+		go s.serveDNS(ctx, a)
+	}
+	s.listenForSocks5Clients(ctx, a)
+	a.log.Info("Agent disconnected", "duration", time.Since(a.ConnectedAt))
+}
+
+// addAgent keeps the agent with the connected ones, until removeAgent.
+// It returns false once the server is shutting down.
+func (s *Server) addAgent(a *Agent) bool {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return false
+	}
+	s.agentsWg.Add(1)
+	s.agents[a] = struct{}{}
+	s.cfg.Metrics.Agents.Set(float64(len(s.agents)))
+	s.mu.Unlock()
+	s.emit(AgentConnected, a, "")
+	return true
+}
+
+func (s *Server) removeAgent(a *Agent) {
+	s.mu.Lock()
+	delete(s.agents, a)
+	s.cfg.Metrics.Agents.Set(float64(len(s.agents)))
+	s.mu.Unlock()
+	s.emit(AgentDisconnected, a, "")
+	s.agentsWg.Done()
+}
+
+// ServeHTTP upgrades the authenticated tunnel requests to the agent WebSocket,
+// and passes the other requests to the fallback. The fallback gets the request as received,
+// so that a reverse proxy adds the peer to the forwarded addresses once.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.isTunnelRequest(r) {
+		s.serveFallback(w, r, http.StatusNotFound)
+		return
+	}
+	remoteAddr := s.remoteAddr(r)
+	s.log.Debug("New agent negotiation", "remote_addr", remoteAddr)
+
+	authz := []byte(r.Header.Get("authorization"))
+	if subtle.ConstantTimeCompare(authz, []byte(s.cfg.Password)) == 0 {
+		reason := "invalid"
+		if len(authz) == 0 {
+			reason = "missing"
+		}
+		s.cfg.Metrics.AuthFailures.Add(1, reason)
+		s.log.Debug("Agent authentication failed", "remote_addr", remoteAddr, "reason", reason)
+		s.serveFallback(w, r, http.StatusForbidden)
+		return
+	}
+	if s.ctx.Err() != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.RemoteAddr = remoteAddr
+	s.wsHandler.ServeHTTP(w, r)
+}
+
+// isTunnelRequest reports whether the request is a WebSocket upgrade on a tunnel path.
+// The other requests are passed to the fallback without authentication.
+func (s *Server) isTunnelRequest(r *http.Request) bool {
+	if !s.isTunnelPath(r.URL.Path) {
+		return false
+	}
+	for _, v := range r.Header.Values("Upgrade") {
+		for _, protocol := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(protocol), "websocket") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) isTunnelPath(path string) bool {
+	if len(s.cfg.TunnelPaths) == 0 {
+		return true
+	}
+	for _, p := range s.cfg.TunnelPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFallback passes the request to the fallback handler or replies with the status code if there is none.
+func (s *Server) serveFallback(w http.ResponseWriter, r *http.Request, code int) {
+	if s.cfg.Fallback == nil {
+		w.WriteHeader(code)
+		return
+	}
+	s.cfg.Fallback.ServeHTTP(w, r)
+}
+
+// agentIP returns the IP address of the agent address, which is stable across its reconnections.
+func agentIP(agentstr string) string {
+	host, _, err := net.SplitHostPort(agentstr)
+	if err != nil {
+		return agentstr
+	}
+	return host
+}
+
+// socksAddress returns the SOCKS5 listen address for the port.
+// The unix socket paths get the port number as a suffix to keep them unique per agent.
+func (s *Server) socksAddress(port uint16) string {
+	if strings.HasPrefix(s.cfg.SocksBind, netutil.UnixPrefix) {
+		return fmt.Sprintf("%s.%d", s.cfg.SocksBind, port)
+	}
+	return fmt.Sprintf("%s:%d", s.cfg.SocksBind, port)
+}
+
+// reusedListener is a SOCKS5 listener of the configuration that is reused by the following agents.
+// It isn't reopened, so Close only interrupts the pending Accept.
+type reusedListener struct {
+	net.Listener
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+func (l reusedListener) Close() error {
+	if d, ok := l.Listener.(deadliner); ok {
+		return d.SetDeadline(time.Now())
+	}
+	return l.Listener.Close()
+}
+
+func (l reusedListener) reset() {
+	if d, ok := l.Listener.(deadliner); ok {
+		d.SetDeadline(time.Time{})
+	}
+}
+
+// listenForSocks5Clients forwards the SOCKS5 clients to the agent until the session is closed or ctx is done.
+// It listens on the first free port from SocksPort, and fails on the other errors than the port in use.
+// On ctx done, it stops accepting clients, drains the forwarded connections and says goodbye to the agent.
+func (s *Server) listenForSocks5Clients(ctx context.Context, a *Agent) error {
+	var ln net.Listener
+	var address string
+	var err error
+
+	port := s.cfg.SocksPort
+	select {
+	case ln = <-s.socksListeners:
+		address = ln.Addr().String()
+		a.log.Info("Waiting for SOCKS5 clients on reused listener", "listen", address)
+	default:
+	}
+	for ln == nil {
+		address = s.socksAddress(port)
+		a.log.Info("Waiting for SOCKS5 clients", "listen", address)
+		ln, err = netutil.Listen(address, s.cfg.SocketMode, s.cfg.SocketOwner)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || port == math.MaxUint16 {
+			a.log.Error("Failed to listen for SOCKS5 clients", "listen", address, "err", err)
+			return err
+		}
+		a.log.Warn("Error listening", "listen", address, "err", err)
+		port++
+	}
+	s.emit(SocksListening, a, address)
+	done := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-a.session.CloseChan():
+		case <-done:
+		case <-ctx.Done():
+		}
+		ln.Close()
+		close(closed)
+	}()
+	defer func() {
+		close(done)
+		<-closed
+		if l, ok := ln.(reusedListener); ok {
+			l.reset()
+			s.socksListeners <- l
+		}
+	}()
+	policy := s.cfg.DNSPolicy.forAgent(a.RemoteAddr)
+	var streams sync.WaitGroup
+	for {
+		conn, err := ln.Accept()
+		if err != nil && ctx.Err() != nil {
+			s.drainAgent(a, &streams)
+			return ctx.Err()
+		}
+		if err != nil {
+			a.log.Info("Stopped accepting SOCKS5 clients", "listen", address, "err", err)
+			return err
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			s.forwardClient(ctx, a, policy, conn)
+		}()
+	}
+}
+
+// forwardClient forwards the SOCKS5 client to the agent through a new stream.
+// With a DNS or destination policy, or the audit log, the server answers the greeting and rewrites the request.
+// With a destination policy, it checks the request and sends only the approved destination to the agent
+// in a connect stream, otherwise it replays the request to the agent, as the older agents understand.
+func (s *Server) forwardClient(ctx context.Context, a *Agent, policy *DNSPolicy, conn net.Conn) {
+	logger := a.log.With("client_addr", conn.RemoteAddr().String())
+	started := time.Now()
+	var stream *yamux.Stream
+	var rec *audit.Record
+	if policy != nil || s.cfg.DestPolicy != nil || s.cfg.Audit != nil {
+		req, user, err := socks.Handshake(conn, s.cfg.DestPolicy.auth())
+		if err != nil {
+			logger.Warn("SOCKS5 handshake failed", "user", user, "err", err)
+			s.cfg.Metrics.SocksConns.Add(1, "failed")
+			conn.Close()
+			return
+		}
+		dst := req.String()
+		logger = logger.With("dst", dst)
+		if user != "" {
+			logger = logger.With("user", user)
+		}
+		rec = &audit.Record{Time: started, ClientAddr: conn.RemoteAddr().String(), User: user, AgentID: a.ID, AgentAddr: a.RemoteAddr, Dst: dst}
+		defer func() {
+			rec.Duration = time.Since(started).Seconds()
+			if err := s.cfg.Audit.Write(rec); err != nil {
+				s.log.Error("Failed to write the audit log", "err", err)
+			}
+		}()
+		reject := func(code byte) {
+			socks.WriteReply(conn, code)
+			rec.Result = socks.ReplyName(code)
+			s.cfg.Metrics.SocksConns.Add(1, "failed")
+			conn.Close()
+		}
+		if req.Cmd != socks.Connect {
+			logger.Warn("Unsupported SOCKS5 command", "cmd", req.Cmd)
+			reject(socks.CommandUnsupported)
+			return
+		}
+		requested := req.Host
+		if err := policy.rewrite(ctx, req); err != nil {
+			logger.Warn("Error resolving the destination", "err", err)
+			reject(socks.HostUnreachable)
+			return
+		}
+		if dst != req.String() {
+			logger.Debug("Rewrote the destination", "rewritten", req.String())
+		}
+		if !req.IsDomain() {
+			rec.ResolvedIP = req.Host
+		}
+		// The names resolved by the agent are checked once it reports their address, if rules match addresses.
+		var approve func(ip string) bool
+		if req.IsDomain() && s.cfg.DestPolicy.needsIP(a.RemoteAddr, user) {
+			approve = func(ip string) bool {
+				return s.cfg.DestPolicy.allowed(a.RemoteAddr, user, []string{requested, req.Host, ip}, req.Port)
+			}
+		} else if !s.cfg.DestPolicy.allowed(a.RemoteAddr, user, []string{requested, req.Host}, req.Port) {
+			logger.Warn("Destination denied by the policy")
+			reject(socks.NotAllowed)
+			return
+		}
+
+		logger.Info("Got client, opening stream")
+		var code byte
+		var reply *socks.Request
+		if s.cfg.DestPolicy != nil {
+			var resolved string
+			stream, code, resolved, err = openConnect(a.session, req, approve)
+			if resolved != "" {
+				rec.ResolvedIP = resolved
+			}
+			if err == nil && stream == nil {
+				logger.Warn("Destination denied by the policy", "resolved_ip", resolved)
+				reject(code)
+				return
+			}
+		} else {
+			if stream, reply, err = replaySocks(a.session, req); err == nil {
+				code = reply.Cmd
+			}
+		}
+		if err != nil {
+			logger.Warn("Error opening stream", "err", err)
+			reject(socks.GeneralFailure)
+			return
+		}
+		rec.StreamID = stream.StreamID()
+		if code != socks.Succeeded {
+			logger.Warn("The agent failed to connect", "stream_id", stream.StreamID(), "result", socks.ReplyName(code))
+			stream.Close()
+			reject(code)
+			return
+		}
+		rec.Result = socks.ReplyName(code)
+		if reply != nil {
+			_, err = conn.Write(reply.Bytes())
+		} else {
+			err = socks.WriteReply(conn, code)
+		}
+		if err != nil {
+			s.cfg.Metrics.SocksConns.Add(1, "failed")
+			conn.Close()
+			stream.Close()
+			return
+		}
+	} else {
+		logger.Info("Got client, opening stream")
+		var err error
+		stream, err = a.session.OpenStream()
+		if err != nil {
+			logger.Warn("Error opening stream", "err", err)
+			s.cfg.Metrics.SocksConns.Add(1, "failed")
+			conn.Close()
+			return
+		}
+	}
+
+	// connect both of conn and stream
+	logger = logger.With("stream_id", stream.StreamID())
+	logger.Info("Forwarding connection")
+	s.cfg.Metrics.SocksConns.Add(1, "accepted")
+	s.cfg.Metrics.Streams.Add(1)
+	defer func() {
+		s.cfg.Metrics.Streams.Add(-1)
+		s.cfg.Metrics.StreamDuration.Observe(time.Since(started).Seconds())
+	}()
+	ip := agentIP(a.RemoteAddr)
+	var bytesIn, bytesOut int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		bytesIn, _ = io.Copy(s.cfg.Metrics.Bytes.With(ip, "in").CountingWriter(conn), stream)
+		conn.Close()
+		logger.Debug("Done forwarding stream to conn", "direction", "in", "bytes", bytesIn)
+	}()
+	go func() {
+		defer wg.Done()
+		bytesOut, _ = io.Copy(s.cfg.Metrics.Bytes.With(ip, "out").CountingWriter(stream), conn)
+		stream.Close()
+		logger.Debug("Done forwarding conn to stream", "direction", "out", "bytes", bytesOut)
+	}()
+	wg.Wait()
+	if rec != nil {
+		rec.BytesSent, rec.BytesReceived = bytesOut, bytesIn
+	}
+	logger.Info("Connection closed", "bytes_in", bytesIn, "bytes_out", bytesOut, "duration", time.Since(started))
+}
+
+// drainAgent waits for the forwarded connections up to the shutdown timeout and says goodbye to the agent.
+func (s *Server) drainAgent(a *Agent, streams *sync.WaitGroup) {
+	a.log.Info("Draining connections")
+	if !tunnel.WaitTimeout(streams, s.cfg.ShutdownTimeout) {
+		a.log.Warn("Timed out draining connections")
+	}
+	if stream, err := a.session.Open(); err == nil {
+		a.log.Info("Saying goodbye to the agent")
+		if err := tunnel.SendGoodbye(stream, tunnel.GoodbyeTimeout); err != nil {
+			a.log.Debug("Error saying goodbye", "err", err)
+		}
+	}
+	a.session.Close()
+}
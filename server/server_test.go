@@ -0,0 +1,470 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metala/revwebsocks5/audit"
+	"github.com/metala/revwebsocks5/client"
+	"github.com/metala/revwebsocks5/internal/testutil"
+	"github.com/metala/revwebsocks5/metrics"
+	"github.com/metala/revwebsocks5/server"
+	xproxy "golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// serveEcho serves a TCP echo server.
+func serveEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func waitEvent(t *testing.T, events <-chan server.Event, want server.EventType) server.Event {
+	t.Helper()
+	for {
+		select {
+		case e := <-events:
+			if e.Type == want {
+				return e
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for the %s event", want)
+		}
+	}
+}
+
+// TestRoundTrip runs the server and the client in-process and echoes through the SOCKS5 listener of the agent,
+// with the request forwarded as is, replayed for the audit log and sent in a connect stream for the policy.
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		audit  bool
+	}{
+		{name: "forwarded"},
+		{name: "replayed", audit: true},
+		{name: "connect", policy: `{"deny": ["10.0.0.0/8"]}`, audit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := testutil.NewCert(t, nil)
+			certFile := cert.WritePEM(t)
+			echo := serveEcho(t)
+			socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			events := make(chan server.Event, 16)
+			cfg := server.Config{
+				Password:       "secret",
+				SocksListeners: []net.Listener{socksLn},
+				Logger:         discard,
+				OnEvent:        func(e server.Event) { events <- e },
+			}
+			if tt.policy != "" {
+				file := filepath.Join(t.TempDir(), "policy.json")
+				if err := os.WriteFile(file, []byte(tt.policy), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if cfg.DestPolicy, err = server.LoadDestPolicy(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var auditFile string
+			if tt.audit {
+				auditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+				if cfg.Audit, err = audit.Open(auditFile, 0, 0); err != nil {
+					t.Fatal(err)
+				}
+				defer cfg.Audit.Close()
+			}
+			srv, err := server.New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts := httptest.NewUnstartedServer(srv)
+			ts.EnableHTTP2 = true
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS()}}
+			ts.StartTLS()
+			defer ts.Close()
+
+			c, err := client.New(client.Config{
+				Endpoints: []*client.Endpoint{{URL: ts.URL, TLSCert: certFile}},
+				Password:  "secret",
+				Logger:    discard,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- c.Run(ctx) }()
+
+			connected := waitEvent(t, events, server.AgentConnected)
+			if e := waitEvent(t, events, server.SocksListening); e.Addr != socksLn.Addr().String() || e.Agent != connected.Agent {
+				t.Fatalf("SocksListening event on %s for %v, want %s for %v", e.Addr, e.Agent, socksLn.Addr(), connected.Agent)
+			}
+			if agents := srv.Agents(); len(agents) != 1 || agents[0] != connected.Agent {
+				t.Fatalf("Agents() = %v, want [%v]", agents, connected.Agent)
+			}
+
+			dialer, err := xproxy.SOCKS5("tcp", socksLn.Addr().String(), nil, xproxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.Dial("tcp", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("read %q, %v, want ping", buf, err)
+			}
+			conn.Close()
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if e := waitEvent(t, events, server.AgentDisconnected); e.Agent != connected.Agent {
+				t.Fatalf("AgentDisconnected event for %v, want %v", e.Agent, connected.Agent)
+			}
+			shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+			defer stop()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				t.Fatalf("Shutdown() = %v", err)
+			}
+
+			if tt.audit {
+				cfg.Audit.Close()
+				data, err := os.ReadFile(auditFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) == 0 {
+					t.Error("empty audit log, want the echo connection")
+				}
+			}
+		})
+	}
+}
+
+// TestShutdownRefusesAgents checks that the server no longer accepts agents once it shuts down.
+func TestShutdownRefusesAgents(t *testing.T) {
+	cert := testutil.NewCert(t, nil)
+	certFile := cert.WritePEM(t)
+	events := make(chan server.Event, 16)
+	srv, err := server.New(server.Config{
+		Password: "secret",
+		Logger:   discard,
+		OnEvent:  func(e server.Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS()}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := client.New(client.Config{
+		Endpoints:      []*client.Endpoint{{URL: ts.URL, TLSCert: certFile}},
+		Password:       "secret",
+		ReconnectLimit: 1,
+		Logger:         discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(context.Background()); err == nil {
+		t.Error("Run() = nil, want the connection refused")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("got the %s event, want none", e.Type)
+	default:
+	}
+}
+
+// startAgent serves srv over TLS and runs an agent connecting to it until the test ends.
+func startAgent(t *testing.T, srv *server.Server, cert *testutil.Cert) {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS()}}
+	ts.StartTLS()
+	c, err := client.New(client.Config{
+		Endpoints: []*client.Endpoint{{URL: ts.URL, TLSCert: cert.WritePEM(t)}},
+		Password:  "secret",
+		Logger:    discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		ts.Close()
+	})
+}
+
+// TestSocksPortInUse checks that the agent gets the next port when the SOCKS5 port is in use.
+func TestSocksPortInUse(t *testing.T) {
+	cert := testutil.NewCert(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	events := make(chan server.Event, 16)
+	srv, err := server.New(server.Config{
+		Password:  "secret",
+		SocksBind: "127.0.0.1",
+		SocksPort: uint16(port),
+		Logger:    discard,
+		OnEvent:   func(e server.Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAgent(t, srv, cert)
+	want := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1))
+	if e := waitEvent(t, events, server.SocksListening); e.Addr != want {
+		t.Fatalf("SocksListening event on %s, want %s", e.Addr, want)
+	}
+}
+
+// TestSocksListenError checks that the agent is dropped when the SOCKS5 listener fails for another reason
+// than the port in use, instead of retrying the following ports.
+func TestSocksListenError(t *testing.T) {
+	cert := testutil.NewCert(t, nil)
+	events := make(chan server.Event, 16)
+	srv, err := server.New(server.Config{
+		Password:   "secret",
+		SocksBind:  "unix:" + filepath.Join(t.TempDir(), "missing", "socks"),
+		SocketMode: 0600,
+		Logger:     discard,
+		OnEvent:    func(e server.Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAgent(t, srv, cert)
+	connected := waitEvent(t, events, server.AgentConnected)
+	if e := waitEvent(t, events, server.AgentDisconnected); e.Agent != connected.Agent {
+		t.Fatalf("AgentDisconnected event for %v, want %v", e.Agent, connected.Agent)
+	}
+}
+
+// TestForwardedFor checks that the agents get the address forwarded by the trusted proxies, while the fallback
+// reverse proxy gets the request as received and adds the peer to X-Forwarded-For once.
+func TestForwardedFor(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer upstream.Close()
+	fallback, err := server.NewFallbackHandler(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := server.ParseTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan server.Event, 16)
+	srv, err := server.New(server.Config{
+		Password:       "secret",
+		Fallback:       fallback,
+		TrustedProxies: trusted,
+		SocksListeners: []net.Listener{socksLn},
+		Logger:         discard,
+		OnEvent:        func(e server.Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/index.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "203.0.113.7, 127.0.0.1"; string(body) != want {
+		t.Errorf("upstream got X-Forwarded-For %q, want %q", body, want)
+	}
+
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Header.Set("Authorization", "secret")
+	cfg.Header.Set("X-Forwarded-For", "203.0.113.7")
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if e := waitEvent(t, events, server.AgentConnected); e.Agent.RemoteAddr != "203.0.113.7" {
+		t.Errorf("agent remote address %s, want 203.0.113.7", e.Agent.RemoteAddr)
+	}
+}
+
+// TestAuthFailures checks that only the WebSocket upgrades on the tunnel paths are authenticated and counted,
+// while the other requests are passed to the fallback.
+func TestAuthFailures(t *testing.T) {
+	registry := metrics.NewRegistry()
+	srv, err := server.New(server.Config{
+		Password:    "secret",
+		TunnelPaths: []string{"/tunnel"},
+		Fallback: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "fallback")
+		}),
+		Metrics: registry,
+		Logger:  discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, path := range []string{"/", "/tunnel"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "fallback" {
+			t.Errorf("GET %s = %q, want the fallback", path, body)
+		}
+	}
+	for _, password := range []string{"", "wrong"} {
+		cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http")+"/tunnel", ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password != "" {
+			cfg.Header.Set("Authorization", password)
+		}
+		if ws, err := websocket.DialConfig(cfg); err == nil {
+			ws.Close()
+			t.Errorf("upgrade with the password %q succeeded", password)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`revwebsocks5_auth_failures_total{reason="missing"} 1`,
+		`revwebsocks5_auth_failures_total{reason="invalid"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("got\n%s\nwant the line %s", w.Body.String(), want)
+		}
+	}
+}
+
+// TestDestPolicyResolvedByAgent checks that the names resolved by the agent are approved with their address.
+func TestDestPolicyResolvedByAgent(t *testing.T) {
+	cert := testutil.NewCert(t, nil)
+	denied, allowed := serveEcho(t), serveEcho(t)
+	_, deniedPort, _ := net.SplitHostPort(denied)
+	_, allowedPort, _ := net.SplitHostPort(allowed)
+	file := filepath.Join(t.TempDir(), "policy.json")
+	policy := `{"deny": ["127.0.0.0/8:` + deniedPort + `", "[::1]:` + deniedPort + `"]}`
+	if err := os.WriteFile(file, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	destPolicy, err := server.LoadDestPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan server.Event, 16)
+	srv, err := server.New(server.Config{
+		Password:       "secret",
+		SocksListeners: []net.Listener{socksLn},
+		DestPolicy:     destPolicy,
+		Logger:         discard,
+		OnEvent:        func(e server.Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAgent(t, srv, cert)
+	waitEvent(t, events, server.SocksListening)
+
+	dialer, err := xproxy.SOCKS5("tcp", socksLn.Addr().String(), nil, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialer.Dial("tcp", net.JoinHostPort("localhost", deniedPort)); err == nil {
+		conn.Close()
+		t.Error("Dial() of a name resolving to a denied address = nil error, want it denied")
+	} else if !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Dial() of a name resolving to a denied address = %v, want it not allowed", err)
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("localhost", allowedPort))
+	if err != nil {
+		t.Fatalf("Dial() of a name resolving to an allowed address = %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,472 @@
+package spy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+const (
+	pcapLinkTypeRaw = 101 // raw IPv4 or IPv6 packets
+
+	pcapBlockSection   = 0x0a0d0d0a
+	pcapBlockInterface = 0x00000001
+	pcapBlockPacket    = 0x00000006
+	pcapOptComment     = 1
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// maxSegment keeps the synthetic packets under the 64 KiB IP packet length.
+	maxSegment = 65000
+	// streamPort is the destination port of the synthetic flows of the tunnelled streams,
+	// so that the SOCKS5 streams are decoded as such.
+	streamPort = 1080
+)
+
+// Capture writes the decrypted tunnel connections, and optionally the yamux streams inside them,
+// as synthetic TCP flows to a pcapng file. The packets are annotated with comments like agent_id and stream_id.
+// A nil Capture captures nothing.
+type Capture struct {
+	streams bool
+
+	mu   sync.Mutex
+	file *os.File
+	err  error // first write error
+}
+
+// OpenCapture creates the pcapng file. With streams, the yamux streams are captured as their own flows too.
+func OpenCapture(path string, streams bool) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{streams: streams, file: f}
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	idb := binary.LittleEndian.AppendUint16(nil, pcapLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	if err := c.writeBlock(pcapBlockSection, shb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := c.writeBlock(pcapBlockInterface, idb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capture) writeBlock(blockType uint32, body []byte) error {
+	size := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(nil, blockType)
+	b = binary.LittleEndian.AppendUint32(b, size)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, size)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.file.Write(b)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// Close closes the pcapng file and returns the first error writing it, if any.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.file.Close()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+// writePacket writes the packet in an enhanced packet block with the comment.
+func (c *Capture) writePacket(packet []byte, comment string) {
+	ts := uint64(time.Now().UnixMicro())
+	b := binary.LittleEndian.AppendUint32(nil, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+	b = appendPadded(b, packet)
+	if comment != "" {
+		b = binary.LittleEndian.AppendUint16(b, pcapOptComment)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(comment)))
+		b = appendPadded(b, []byte(comment))
+		b = append(b, 0, 0, 0, 0)
+	}
+	c.writeBlock(pcapBlockPacket, b)
+}
+
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// tcpFlow is a synthetic TCP connection from the endpoint 0, which opened it, to the endpoint 1.
+type tcpFlow struct {
+	capture *Capture
+	ips     [2]net.IP
+	ports   [2]uint16
+
+	mu      sync.Mutex
+	comment string
+	seq     [2]uint32
+	fin     [2]bool
+}
+
+// newFlow opens the flow with the TCP handshake. The addresses without an IP get a loopback address.
+func (c *Capture) newFlow(from, to string, comment string) *tcpFlow {
+	f := &tcpFlow{capture: c, comment: comment}
+	for i, addr := range []string{from, to} {
+		host, port, _ := net.SplitHostPort(addr)
+		f.ips[i] = net.ParseIP(host)
+		if f.ips[i] == nil {
+			f.ips[i] = net.IPv4(127, 0, 0, byte(1+i))
+		}
+		p, _ := strconv.ParseUint(port, 10, 16)
+		f.ports[i] = uint16(p)
+	}
+	if f.ips[0].To4() == nil || f.ips[1].To4() == nil {
+		f.ips[0], f.ips[1] = f.ips[0].To16(), f.ips[1].To16()
+	} else {
+		f.ips[0], f.ips[1] = f.ips[0].To4(), f.ips[1].To4()
+	}
+	f.segment(0, tcpSYN, nil)
+	f.seq[0]++
+	f.segment(1, tcpSYN|tcpACK, nil)
+	f.seq[1]++
+	f.segment(0, tcpACK, nil)
+	return f
+}
+
+// annotate sets the comment of the next packets.
+func (f *tcpFlow) annotate(comment string) {
+	f.mu.Lock()
+	f.comment = comment
+	f.mu.Unlock()
+}
+
+// data sends the data from the endpoint dir.
+func (f *tcpFlow) data(dir int, p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		f.segment(dir, tcpPSH|tcpACK, p[:n])
+		f.seq[dir] += uint32(n)
+		p = p[n:]
+	}
+}
+
+// close sends the FIN, or the RST with reset, from the endpoint dir. It reports whether the flow is over.
+func (f *tcpFlow) close(dir int, reset bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if reset {
+		f.segment(dir, tcpRST|tcpACK, nil)
+		f.fin = [2]bool{true, true}
+		return true
+	}
+	if !f.fin[dir] {
+		f.segment(dir, tcpFIN|tcpACK, nil)
+		f.seq[dir]++
+		f.fin[dir] = true
+	}
+	return f.fin[0] && f.fin[1]
+}
+
+// segment writes the TCP segment from the endpoint dir, with the IPv4 or IPv6 header.
+func (f *tcpFlow) segment(dir int, flags byte, payload []byte) {
+	src, dst := f.ips[dir], f.ips[1-dir]
+	tcp := binary.BigEndian.AppendUint16(nil, f.ports[dir])
+	tcp = binary.BigEndian.AppendUint16(tcp, f.ports[1-dir])
+	tcp = binary.BigEndian.AppendUint32(tcp, f.seq[dir])
+	ack := uint32(0)
+	if flags&tcpACK != 0 {
+		ack = f.seq[1-dir]
+	}
+	tcp = binary.BigEndian.AppendUint32(tcp, ack)
+	tcp = append(tcp, 5<<4, flags, 0xff, 0xff, 0, 0, 0, 0)
+	tcp = append(tcp, payload...)
+
+	var ip []byte
+	var pseudo []byte
+	if len(src) == net.IPv4len {
+		ip = []byte{0x45, 0}
+		ip = binary.BigEndian.AppendUint16(ip, uint16(20+len(tcp)))
+		ip = append(ip, 0, 0, 0x40, 0, 64, 6, 0, 0)
+		ip = append(append(ip, src...), dst...)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		pseudo = append(append(pseudo, src...), dst...)
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		ip = []byte{0x60, 0, 0, 0}
+		ip = binary.BigEndian.AppendUint16(ip, uint16(len(tcp)))
+		ip = append(ip, 6, 64)
+		ip = append(append(ip, src...), dst...)
+		pseudo = append(append(pseudo, src...), dst...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	f.capture.writePacket(append(ip, tcp...), f.comment)
+}
+
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+// captureConn captures the connection as a flow. Its reads come from the endpoint readDir.
+type captureConn struct {
+	net.Conn
+
+	flow    *tcpFlow
+	readDir int
+	once    sync.Once
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.flow.data(c.readDir, p[:n])
+	if err != nil {
+		c.closeFlow()
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.flow.data(1-c.readDir, p[:n])
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.closeFlow()
+	return c.Conn.Close()
+}
+
+func (c *captureConn) closeFlow() {
+	c.once.Do(func() {
+		c.flow.close(1-c.readDir, false)
+		c.flow.close(c.readDir, false)
+	})
+}
+
+// Conn captures the dialed connection, or returns it as is without capture.
+func (c *Capture) Conn(conn net.Conn, comment string) net.Conn {
+	if c == nil {
+		return conn
+	}
+	flow := c.newFlow(conn.LocalAddr().String(), conn.RemoteAddr().String(), comment)
+	return &captureConn{Conn: conn, flow: flow, readDir: 1}
+}
+
+// captureListener captures the accepted connections.
+type captureListener struct {
+	net.Listener
+
+	capture *Capture
+}
+
+func (l captureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	flow := l.capture.newFlow(conn.RemoteAddr().String(), conn.LocalAddr().String(), "remote_addr="+conn.RemoteAddr().String())
+	return &captureConn{Conn: conn, flow: flow, readDir: 0}, nil
+}
+
+// Listener captures the connections accepted by ln, or returns it as is without capture.
+func (c *Capture) Listener(ln net.Listener) net.Listener {
+	if c == nil {
+		return ln
+	}
+	return captureListener{ln, c}
+}
+
+type captureConnKey struct{}
+
+// ConnContext keeps the captured connection in the context of its requests, as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, captureConnKey{}, c)
+}
+
+// AnnotateConn sets the comment of the captured connection of the request context, if any.
+func AnnotateConn(ctx context.Context, comment string) {
+	if c, ok := ctx.Value(captureConnKey{}).(*captureConn); ok {
+		c.flow.annotate(comment)
+	}
+}
+
+// captureMux captures the yamux streams carried by the tunnel connection as flows,
+// opened by the side sending their SYN frame. The reads come from the remote side.
+type captureMux struct {
+	io.ReadWriteCloser
+
+	capture *Capture
+	addrs   [2]string // local and remote
+	comment string
+
+	mu      sync.Mutex
+	parsers [2]muxParser
+	flows   map[uint32]*tcpFlow
+	openers map[uint32]int
+}
+
+// muxParser follows the yamux frames of a direction.
+type muxParser struct {
+	hdr       [tunnel.YamuxHeaderSize]byte
+	n         int
+	streamID  uint32
+	flags     uint16
+	remaining uint32
+}
+
+// Mux captures the yamux streams of the tunnel connection between the local and the remote addresses,
+// or returns it as is without stream capture.
+func (c *Capture) Mux(rwc io.ReadWriteCloser, local, remote, comment string) io.ReadWriteCloser {
+	if c == nil || !c.streams {
+		return rwc
+	}
+	return &captureMux{
+		ReadWriteCloser: rwc,
+		capture:         c,
+		addrs:           [2]string{local, remote},
+		comment:         comment,
+		flows:           make(map[uint32]*tcpFlow),
+		openers:         make(map[uint32]int),
+	}
+}
+
+func (m *captureMux) Read(p []byte) (int, error) {
+	n, err := m.ReadWriteCloser.Read(p)
+	m.parse(1, p[:n])
+	return n, err
+}
+
+func (m *captureMux) Write(p []byte) (int, error) {
+	n, err := m.ReadWriteCloser.Write(p)
+	m.parse(0, p[:n])
+	return n, err
+}
+
+// parse follows the frames sent by the side, 0 for local and 1 for remote.
+func (m *captureMux) parse(side int, p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ps := &m.parsers[side]
+	for len(p) > 0 {
+		if ps.remaining > 0 {
+			n := uint32(len(p))
+			if n > ps.remaining {
+				n = ps.remaining
+			}
+			if f, dir := m.flow(side, ps.streamID); f != nil {
+				f.data(dir, p[:n])
+			}
+			p = p[n:]
+			ps.remaining -= n
+			if ps.remaining == 0 {
+				m.endFrame(side, ps)
+			}
+			continue
+		}
+		n := copy(ps.hdr[ps.n:], p)
+		ps.n += n
+		p = p[n:]
+		if ps.n < len(ps.hdr) {
+			break
+		}
+		ps.n = 0
+		ps.flags = binary.BigEndian.Uint16(ps.hdr[2:])
+		ps.streamID = binary.BigEndian.Uint32(ps.hdr[4:])
+		// The frames of the streams opened before the capture, or already over, are dropped.
+		if ps.streamID != 0 && ps.flags&tunnel.YamuxFlagSYN != 0 && m.flows[ps.streamID] == nil {
+			m.openFlow(side, ps.streamID)
+		}
+		if ps.hdr[1] == tunnel.YamuxTypeData {
+			ps.remaining = binary.BigEndian.Uint32(ps.hdr[8:])
+		}
+		if ps.remaining == 0 {
+			m.endFrame(side, ps)
+		}
+	}
+}
+
+func (m *captureMux) openFlow(side int, id uint32) {
+	from, to := m.addrs[side], m.addrs[1-side]
+	fromHost, _, _ := net.SplitHostPort(from)
+	toHost, _, _ := net.SplitHostPort(to)
+	from = net.JoinHostPort(fromHost, strconv.Itoa(int(1024+id%64000)))
+	to = net.JoinHostPort(toHost, strconv.Itoa(streamPort))
+	f := m.capture.newFlow(from, to, m.comment+" stream_id="+strconv.Itoa(int(id)))
+	m.flows[id] = f
+	m.openers[id] = side
+}
+
+// flow returns the flow of the stream and the direction of the side in it.
+func (m *captureMux) flow(side int, id uint32) (*tcpFlow, int) {
+	f := m.flows[id]
+	if f == nil {
+		return nil, 0
+	}
+	if m.openers[id] == side {
+		return f, 0
+	}
+	return f, 1
+}
+
+// endFrame applies the FIN and RST flags once the frame is over.
+func (m *captureMux) endFrame(side int, ps *muxParser) {
+	if ps.flags&(tunnel.YamuxFlagFIN|tunnel.YamuxFlagRST) == 0 {
+		return
+	}
+	f, dir := m.flow(side, ps.streamID)
+	if f != nil && f.close(dir, ps.flags&tunnel.YamuxFlagRST != 0) {
+		delete(m.flows, ps.streamID)
+		delete(m.openers, ps.streamID)
+	}
+}
@@ -0,0 +1,210 @@
+package spy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+// yamuxFrame returns the yamux frame of the stream with the payload, if a data frame.
+func yamuxFrame(typ byte, flags uint16, id uint32, payload string) []byte {
+	b := []byte{0, typ}
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// nopMux is the tunnel connection of the captured mux, reading the remote frames.
+type nopMux struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopMux) Close() error { return nil }
+
+// capturedSegment is a TCP segment decoded from the pcapng file.
+type capturedSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	payload          string
+	comment          string
+}
+
+// onesSum returns the ones' complement sum of the 16-bit words of the buffers.
+func onesSum(bufs ...[]byte) uint16 {
+	var s uint32
+	for _, b := range bufs {
+		for i := 0; i < len(b); i += 2 {
+			w := uint32(b[i]) << 8
+			if i+1 < len(b) {
+				w |= uint32(b[i+1])
+			}
+			s += w
+		}
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// readCapture decodes the pcapng file, checking the block lengths, the section and interface blocks,
+// and the IPv4 and TCP checksums of the packets.
+func readCapture(t *testing.T, path string) []capturedSegment {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []uint32
+	var segments []capturedSegment
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block of %d bytes", len(data))
+		}
+		typ, size := binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:])
+		if size%4 != 0 || int(size) > len(data) || binary.LittleEndian.Uint32(data[size-4:]) != size {
+			t.Fatalf("block 0x%x has the invalid length %d", typ, size)
+		}
+		body := data[8 : size-4]
+		data = data[size:]
+		types = append(types, typ)
+
+		switch typ {
+		case pcapBlockSection:
+			if binary.LittleEndian.Uint32(body) != 0x1a2b3c4d || binary.LittleEndian.Uint16(body[4:]) != 1 {
+				t.Fatalf("section header = %x", body)
+			}
+		case pcapBlockInterface:
+			if binary.LittleEndian.Uint16(body) != pcapLinkTypeRaw {
+				t.Fatalf("link type = %d, want raw", binary.LittleEndian.Uint16(body))
+			}
+		case pcapBlockPacket:
+			if binary.LittleEndian.Uint32(body) != 0 {
+				t.Fatalf("interface id = %d, want 0", binary.LittleEndian.Uint32(body))
+			}
+			n := binary.LittleEndian.Uint32(body[12:])
+			if binary.LittleEndian.Uint32(body[16:]) != n {
+				t.Fatal("captured and original lengths differ")
+			}
+			packet := body[20 : 20+n]
+			var comment string
+			if opts := body[20+(n+3)/4*4:]; len(opts) > 0 {
+				if binary.LittleEndian.Uint16(opts) != pcapOptComment {
+					t.Fatalf("option %d, want a comment", binary.LittleEndian.Uint16(opts))
+				}
+				comment = string(opts[4 : 4+binary.LittleEndian.Uint16(opts[2:])])
+			}
+
+			ip, tcp := packet[:20], packet[20:]
+			if ip[0] != 0x45 || ip[9] != 6 || int(binary.BigEndian.Uint16(ip[2:])) != len(packet) {
+				t.Fatalf("IPv4 header = %x", ip)
+			}
+			if onesSum(ip) != 0xffff {
+				t.Fatalf("IPv4 header checksum of %x is invalid", ip)
+			}
+			pseudo := append(append([]byte{}, ip[12:20]...), 0, 6)
+			pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+			if onesSum(pseudo, tcp) != 0xffff {
+				t.Fatalf("TCP checksum of %x is invalid", tcp)
+			}
+			segments = append(segments, capturedSegment{
+				srcPort: binary.BigEndian.Uint16(tcp),
+				dstPort: binary.BigEndian.Uint16(tcp[2:]),
+				seq:     binary.BigEndian.Uint32(tcp[4:]),
+				ack:     binary.BigEndian.Uint32(tcp[8:]),
+				flags:   tcp[13],
+				payload: string(tcp[20:]),
+				comment: comment,
+			})
+		default:
+			t.Fatalf("unexpected block type 0x%x", typ)
+		}
+	}
+	if len(types) < 2 || types[0] != pcapBlockSection || types[1] != pcapBlockInterface {
+		t.Fatalf("block types = %x, want the section and interface blocks first", types)
+	}
+	return segments
+}
+
+func TestCaptureMux(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	c, err := OpenCapture(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remote bytes.Buffer
+	m := c.Mux(nopMux{&remote, io.Discard}, "10.0.0.1:40000", "10.0.0.2:443", "agent_id=a")
+	local := func(frames ...[]byte) {
+		for _, f := range frames {
+			if _, err := m.Write(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(frames ...[]byte) {
+		for _, f := range frames {
+			remote.Write(f)
+		}
+		// Read in small chunks, so the frames and the payloads are split across reads.
+		buf := make([]byte, 5)
+		for remote.Len() > 0 {
+			if _, err := m.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The frames of the stream 7, opened before the capture, are dropped.
+	local(yamuxFrame(tunnel.YamuxTypeData, 0, 7, "dropped"))
+	local(
+		yamuxFrame(tunnel.YamuxTypeWindowUpdate, tunnel.YamuxFlagSYN, 1, ""),
+		yamuxFrame(tunnel.YamuxTypeData, 0, 1, "hello"),
+	)
+	read(
+		yamuxFrame(tunnel.YamuxTypeWindowUpdate, tunnel.YamuxFlagACK, 1, ""),
+		yamuxFrame(tunnel.YamuxTypeData, 0, 1, "world!"),
+		yamuxFrame(tunnel.YamuxTypePing, tunnel.YamuxFlagSYN, 0, ""),
+		yamuxFrame(tunnel.YamuxTypeData, 0, 7, "dropped"),
+	)
+	local(yamuxFrame(tunnel.YamuxTypeWindowUpdate, tunnel.YamuxFlagFIN, 1, ""))
+	read(yamuxFrame(tunnel.YamuxTypeData, tunnel.YamuxFlagFIN, 1, ""))
+	// The frames after the stream is over are dropped too.
+	local(yamuxFrame(tunnel.YamuxTypeData, 0, 1, "late"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const opener, server = 1025, streamPort
+	want := []capturedSegment{
+		{opener, server, 0, 0, tcpSYN, "", ""},
+		{server, opener, 0, 1, tcpSYN | tcpACK, "", ""},
+		{opener, server, 1, 1, tcpACK, "", ""},
+		{opener, server, 1, 1, tcpPSH | tcpACK, "hello", ""},
+		{server, opener, 1, 6, tcpPSH | tcpACK, "w", ""},
+		{server, opener, 2, 6, tcpPSH | tcpACK, "orld!", ""},
+		{opener, server, 6, 7, tcpFIN | tcpACK, "", ""},
+		{server, opener, 7, 7, tcpFIN | tcpACK, "", ""},
+	}
+	got := readCapture(t, path)
+	if len(got) != len(want) {
+		t.Fatalf("captured %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i, s := range got {
+		if s.comment != "agent_id=a stream_id=1" {
+			t.Errorf("segment %d comment = %q", i, s.comment)
+		}
+		s.comment = ""
+		if s != want[i] {
+			t.Errorf("segment %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+}
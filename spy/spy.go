@@ -0,0 +1,440 @@
+// Package spy traces and captures the tunnel connections for debugging: hex dumps, decoded tunnel layers
+// and pcapng captures.
+package spy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+// rwcSpy dumps the data read and written in hex to the logger.
+type rwcSpy struct {
+	io.ReadWriteCloser
+
+	logger *log.Logger
+	in     *redactor
+	out    *redactor
+}
+
+func newRwcSpy(rwc io.ReadWriteCloser, l *log.Logger) rwcSpy {
+	return rwcSpy{rwc, l, &redactor{}, &redactor{}}
+}
+
+func (s *rwcSpy) Read(p []byte) (n int, err error) {
+	n, err = s.ReadWriteCloser.Read(p)
+	s.logger.Printf("Read(): err=%s, n=%d, p <=", err, n)
+	data := s.in.redact(p[:n])
+	if err != nil {
+		data = append(data, s.in.flush()...)
+	}
+	Xxd(bytes.NewReader(data), s.logger.Writer())
+	return n, err
+}
+
+func (s *rwcSpy) Write(p []byte) (n int, err error) {
+	n, err = s.ReadWriteCloser.Write(p)
+	s.logger.Printf("Write(): err=%s, n=%d, p =>", err, n)
+	buf := bytes.NewBuffer(nil)
+	Xxd(bytes.NewReader(s.out.redact(p[:n])), buf)
+	s.logger.Writer().Write(buf.Bytes())
+	return n, err
+}
+
+func (s *rwcSpy) Close() error {
+	// Dump the start of the last lines held back by the redactors.
+	for _, r := range []*redactor{s.in, s.out} {
+		if p := r.flush(); len(p) > 0 {
+			Xxd(bytes.NewReader(p), s.logger.Writer())
+		}
+	}
+	err := s.ReadWriteCloser.Close()
+	s.logger.Printf("Close(): err=%s", err)
+	closeTrace(s.logger)
+	return err
+}
+
+type netConnSpy struct {
+	rwcSpy
+
+	conn net.Conn
+}
+
+// NewConnSpy returns the connection logging its calls and dumping its traffic in hex to the logger,
+// with the credential headers redacted. Closing it closes the trace file of the logger.
+func NewConnSpy(conn net.Conn, l *log.Logger) net.Conn {
+	return netConnSpy{newRwcSpy(conn, l), conn}
+}
+
+func (s netConnSpy) Read(p []byte) (n int, err error) {
+	return s.rwcSpy.Read(p)
+}
+
+func (s netConnSpy) Write(p []byte) (n int, err error) {
+	return s.rwcSpy.Write(p)
+}
+
+func (s netConnSpy) Close() error {
+	return s.rwcSpy.Close()
+}
+
+func (s netConnSpy) LocalAddr() net.Addr {
+	result := s.conn.LocalAddr()
+	s.rwcSpy.logger.Printf("LocalAddr(): result=%s", result)
+	return result
+}
+
+func (s netConnSpy) RemoteAddr() net.Addr {
+	result := s.conn.RemoteAddr()
+	s.rwcSpy.logger.Printf("RemoteAddr(): result=%s", result)
+	return result
+}
+
+func (s netConnSpy) SetDeadline(t time.Time) error {
+	err := s.conn.SetDeadline(t)
+	s.rwcSpy.logger.Printf("SetDeadline(): t=%s, err=%s", t, err)
+	return err
+}
+
+func (s netConnSpy) SetReadDeadline(t time.Time) error {
+	err := s.conn.SetReadDeadline(t)
+	s.rwcSpy.logger.Printf("SetReadDeadline(): t=%s, err=%s", t, err)
+	return err
+}
+
+func (s netConnSpy) SetWriteDeadline(t time.Time) error {
+	err := s.conn.SetWriteDeadline(t)
+	s.rwcSpy.logger.Printf("SetWriteDeadline(): t=%s, err=%s", t, err)
+	return err
+}
+
+// Xxd dumps r in hex to w, 16 bytes per line, like xxd does.
+func Xxd(r io.Reader, w io.Writer) error {
+	base := 0
+	for {
+		xb := strings.Builder{}
+		xb.WriteString(fmt.Sprintf("%08x: ", base))
+
+		var b [16]byte
+		n, err := io.ReadFull(r, b[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			xb.WriteString(fmt.Sprintf("%02x ", b[i]))
+			if b[i] < 32 || b[i] >= 127 {
+				b[i] = '.'
+			}
+		}
+		for i := n; i < 16; i++ {
+			xb.WriteString("   ")
+		}
+
+		xb.WriteByte(' ')
+		xb.Write(b[:n])
+		xb.WriteByte('\n')
+		w.Write([]byte(xb.String()))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		base += 16
+	}
+	return nil
+}
+
+// decodeConn logs the layers of the tunnel connection, the HTTP upgrade, the WebSocket frames
+// and the yamux frames, instead of hex dumps.
+type decodeConn struct {
+	net.Conn
+
+	in  *frameDecoder
+	out *frameDecoder
+}
+
+// NewDecodeConn returns the connection logging the decoded tunnel layers to the logger.
+// The payloads are dumped in hex only with payload. Closing it closes the trace file of the logger.
+func NewDecodeConn(conn net.Conn, l *log.Logger, payload bool) net.Conn {
+	return &decodeConn{conn, &frameDecoder{logger: l, dir: "<=", dump: payload}, &frameDecoder{logger: l, dir: "=>", dump: payload}}
+}
+
+func (c *decodeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.feed(p[:n])
+	if err != nil {
+		c.in.flush()
+	}
+	return n, err
+}
+
+func (c *decodeConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.feed(p[:n])
+	return n, err
+}
+
+func (c *decodeConn) Close() error {
+	c.in.flush()
+	c.out.flush()
+	err := c.Conn.Close()
+	c.in.logger.Printf("closed, err=%v", err)
+	closeTrace(c.in.logger)
+	return err
+}
+
+// maxHTTPHead is the size of the HTTP head after which the decoder gives up.
+const maxHTTPHead = 64 << 10
+
+var (
+	wsOpcodes  = map[byte]string{0: "continuation", 1: "text", 2: "binary", 8: "close", 9: "ping", 10: "pong"}
+	yamuxTypes = map[byte]string{
+		tunnel.YamuxTypeData:         "data",
+		tunnel.YamuxTypeWindowUpdate: "window-update",
+		tunnel.YamuxTypePing:         "ping",
+		tunnel.YamuxTypeGoAway:       "go-away",
+	}
+)
+
+// frameDecoder decodes a direction of the tunnel connection. It buffers the data until a header is complete.
+type frameDecoder struct {
+	logger *log.Logger
+	dir    string
+	dump   bool
+
+	buf      []byte
+	upgraded bool // the HTTP head is over
+	raw      bool // the data can't be decoded anymore
+
+	wsOpcode    byte
+	wsMask      []byte
+	wsRemaining uint64
+	wsOffset    uint64
+
+	yamux          []byte
+	yamuxRemaining uint32
+	yamuxStream    uint32
+	yamuxEnd       bool // the data frame ends the stream with FIN or RST
+
+	redactors map[uint32]*redactor // per yamux stream, 0 for the data out of the yamux streams
+}
+
+func (d *frameDecoder) feed(p []byte) {
+	if d.raw {
+		d.payload(0, p)
+		return
+	}
+	d.buf = append(d.buf, p...)
+	if !d.upgraded && !d.decodeHTTP() {
+		return
+	}
+	for len(d.buf) > 0 && !d.raw {
+		if d.wsRemaining == 0 && !d.decodeWebSocketHeader() {
+			return
+		}
+		n := uint64(len(d.buf))
+		if n > d.wsRemaining {
+			n = d.wsRemaining
+		}
+		data := d.buf[:n]
+		if d.wsMask != nil {
+			for i := range data {
+				data[i] ^= d.wsMask[(d.wsOffset+uint64(i))%4]
+			}
+		}
+		d.wsOffset += n
+		d.wsRemaining -= n
+		d.buf = d.buf[n:]
+		if d.wsOpcode <= 2 {
+			d.decodeYamux(data)
+		} else {
+			d.payload(0, data)
+		}
+	}
+}
+
+// decodeHTTP logs the HTTP head once it is complete and reports whether it is over.
+func (d *frameDecoder) decodeHTTP() bool {
+	end := bytes.Index(d.buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(d.buf) > maxHTTPHead {
+			d.logger.Printf("%s no HTTP head in %d bytes, not decoding", d.dir, len(d.buf))
+			d.raw = true
+			d.payload(0, d.buf)
+			d.buf = nil
+		}
+		return false
+	}
+	for _, line := range strings.Split(string(RedactHeaders(d.buf[:end])), "\r\n") {
+		d.logger.Printf("%s HTTP %s", d.dir, line)
+	}
+	d.buf = d.buf[end+4:]
+	d.upgraded = true
+	return true
+}
+
+// decodeWebSocketHeader logs the WebSocket frame header once it is complete and reports whether it was.
+func (d *frameDecoder) decodeWebSocketHeader() bool {
+	if len(d.buf) < 2 {
+		return false
+	}
+	size := 2
+	length := uint64(d.buf[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	masked := d.buf[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	if len(d.buf) < size {
+		return false
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(d.buf[2:]))
+	case 127:
+		length = binary.BigEndian.Uint64(d.buf[2:])
+	}
+	fin := d.buf[0]&0x80 != 0
+	d.wsOpcode = d.buf[0] & 0x0f
+	d.wsMask = nil
+	if masked {
+		d.wsMask = append([]byte{}, d.buf[size-4:size]...)
+	}
+	opcode, ok := wsOpcodes[d.wsOpcode]
+	if !ok {
+		opcode = fmt.Sprintf("0x%x", d.wsOpcode)
+	}
+	d.logger.Printf("%s WebSocket fin=%t opcode=%s masked=%t length=%d", d.dir, fin, opcode, masked, length)
+	d.buf = d.buf[size:]
+	d.wsRemaining, d.wsOffset = length, 0
+	return true
+}
+
+// decodeYamux logs the yamux frames of the WebSocket payload.
+func (d *frameDecoder) decodeYamux(p []byte) {
+	for len(p) > 0 {
+		if d.yamuxRemaining > 0 {
+			n := uint32(len(p))
+			if n > d.yamuxRemaining {
+				n = d.yamuxRemaining
+			}
+			d.payload(d.yamuxStream, p[:n])
+			d.yamuxRemaining -= n
+			p = p[n:]
+			if d.yamuxRemaining == 0 && d.yamuxEnd {
+				d.flushStream(d.yamuxStream)
+			}
+			continue
+		}
+		n := tunnel.YamuxHeaderSize - len(d.yamux)
+		if n > len(p) {
+			n = len(p)
+		}
+		d.yamux = append(d.yamux, p[:n]...)
+		p = p[n:]
+		if len(d.yamux) < tunnel.YamuxHeaderSize {
+			return
+		}
+		hdr := d.yamux
+		d.yamux = nil
+		if hdr[0] != 0 {
+			d.logger.Printf("%s unsupported yamux version %d, not decoding", d.dir, hdr[0])
+			d.raw = true
+			d.payload(0, p)
+			return
+		}
+		typ, ok := yamuxTypes[hdr[1]]
+		if !ok {
+			typ = fmt.Sprintf("0x%x", hdr[1])
+		}
+		id := binary.BigEndian.Uint32(hdr[4:])
+		length := binary.BigEndian.Uint32(hdr[8:])
+		flags := binary.BigEndian.Uint16(hdr[2:])
+		end := flags&(tunnel.YamuxFlagFIN|tunnel.YamuxFlagRST) != 0
+		field := "length"
+		switch hdr[1] {
+		case tunnel.YamuxTypeData:
+			d.yamuxRemaining, d.yamuxStream, d.yamuxEnd = length, id, end
+		case tunnel.YamuxTypeWindowUpdate:
+			field = "delta"
+		case tunnel.YamuxTypePing:
+			field = "opaque"
+		case tunnel.YamuxTypeGoAway:
+			field = "code"
+		}
+		d.logger.Printf("%s yamux type=%s flags=%s stream=%d %s=%d", d.dir, typ, yamuxFlags(flags), id, field, length)
+		if end && d.yamuxRemaining == 0 {
+			d.flushStream(id)
+		}
+	}
+}
+
+func yamuxFlags(flags uint16) string {
+	var names []string
+	for _, f := range []struct {
+		flag uint16
+		name string
+	}{{tunnel.YamuxFlagSYN, "SYN"}, {tunnel.YamuxFlagACK, "ACK"}, {tunnel.YamuxFlagFIN, "FIN"}, {tunnel.YamuxFlagRST, "RST"}} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
+
+// payload dumps the data of the yamux stream if enabled, with the credential headers redacted.
+func (d *frameDecoder) payload(stream uint32, p []byte) {
+	if !d.dump || len(p) == 0 {
+		return
+	}
+	r := d.redactors[stream]
+	if r == nil {
+		if d.redactors == nil {
+			d.redactors = make(map[uint32]*redactor)
+		}
+		r = &redactor{}
+		d.redactors[stream] = r
+	}
+	if p = r.redact(p); len(p) > 0 {
+		Xxd(bytes.NewReader(p), d.logger.Writer())
+	}
+}
+
+// flushStream dumps the start of the last line held back by the redactor of the yamux stream, once it is over.
+func (d *frameDecoder) flushStream(stream uint32) {
+	r := d.redactors[stream]
+	if r == nil {
+		return
+	}
+	delete(d.redactors, stream)
+	if p := r.flush(); d.dump && len(p) > 0 {
+		Xxd(bytes.NewReader(p), d.logger.Writer())
+	}
+}
+
+// flush dumps the start of the last lines held back by the redactors, at the end of the connection.
+func (d *frameDecoder) flush() {
+	streams := make([]uint32, 0, len(d.redactors))
+	for stream := range d.redactors {
+		streams = append(streams, stream)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i] < streams[j] })
+	for _, stream := range streams {
+		d.flushStream(stream)
+	}
+}
@@ -0,0 +1,219 @@
+package spy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metala/revwebsocks5/internal/rotate"
+)
+
+var (
+	traceNameRe  = regexp.MustCompile(`[^\w.-]+`)
+	traceFileRe  = regexp.MustCompile(`^\d{8}-\d{6}-\d+-\d+-[\w.-]*\.log$`)
+	traceHeaders = [][]byte{[]byte("authorization:"), []byte("proxy-authorization:"), []byte("cookie:")}
+)
+
+// Tracer traces the connections and the streams, to Output with the trace name as prefix or,
+// with Dir, to a trace file of their own rotated by size. A nil Tracer traces nothing.
+type Tracer struct {
+	Dir        string
+	MaxSize    int64 // trace file size in bytes triggering the rotation, 0 to disable
+	MaxBackups int   // rotated trace files to keep per trace
+	MaxFiles   int   // trace files to keep in Dir, 0 for all
+	Payload    bool  // dump the tunnel payloads in hex in the decoded traces
+	Output     io.Writer
+
+	seq    uint64
+	once   sync.Once
+	mu     sync.Mutex // guards traces
+	traces []string   // trace files in Dir, oldest first
+}
+
+// Streams reports whether the tunnelled streams are traced too, which is only done to files.
+func (t *Tracer) Streams() bool {
+	return t != nil && t.Dir != ""
+}
+
+// Conn returns the connection dumping its traffic in hex to the trace, or conn itself with a nil Tracer.
+func (t *Tracer) Conn(conn net.Conn, name string) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return NewConnSpy(conn, t.Logger(name))
+}
+
+// Decode returns the connection decoding the tunnel layers to the trace, or conn itself with a nil Tracer.
+func (t *Tracer) Decode(conn net.Conn, name string) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return NewDecodeConn(conn, t.Logger(name), t.Payload)
+}
+
+// Logger returns the logger of the trace of a connection or a stream. The oldest trace files are removed
+// beyond MaxFiles. If the trace file can't be opened, the logger writes to Output with the error.
+func (t *Tracer) Logger(name string) *log.Logger {
+	output := t.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	if t.Dir == "" {
+		return log.New(output, "["+name+"] ", log.LstdFlags)
+	}
+	filename := fmt.Sprintf("%s-%d-%06d-%s.log", time.Now().Format("20060102-150405"), os.Getpid(),
+		atomic.AddUint64(&t.seq, 1), traceNameRe.ReplaceAllString(name, "_"))
+	f, err := rotate.Open(filepath.Join(t.Dir, filename), t.MaxSize, t.MaxBackups)
+	if err != nil {
+		l := log.New(output, "["+name+"] ", log.LstdFlags)
+		l.Printf("failed to open the trace file, err=%v", err)
+		return l
+	}
+	t.prune(filename)
+	return log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+}
+
+// closeTrace closes the trace file of the logger, if it has one.
+func closeTrace(l *log.Logger) {
+	if f, ok := l.Writer().(*rotate.File); ok {
+		f.Close()
+	}
+}
+
+// prune adds the new trace file to the trace files of Dir, listed once, and removes the oldest ones
+// and their backups beyond MaxFiles.
+func (t *Tracer) prune(filename string) {
+	if t.MaxFiles <= 0 {
+		return
+	}
+	t.once.Do(func() {
+		entries, err := os.ReadDir(t.Dir)
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, e := range entries {
+			if traceFileRe.MatchString(e.Name()) && e.Name() != filename {
+				t.traces = append(t.traces, e.Name())
+			}
+		}
+	})
+	t.mu.Lock()
+	t.traces = append(t.traces, filename)
+	var removed []string
+	if n := len(t.traces) - t.MaxFiles; n > 0 {
+		removed = append(removed, t.traces[:n]...)
+		t.traces = append(t.traces[:0], t.traces[n:]...)
+	}
+	t.mu.Unlock()
+	for _, name := range removed {
+		path := filepath.Join(t.Dir, name)
+		os.Remove(path)
+		for i := 1; i <= t.MaxBackups; i++ {
+			os.Remove(fmt.Sprintf("%s.%d", path, i))
+		}
+	}
+}
+
+// RedactHeaders masks the values of the Authorization, Proxy-Authorization and Cookie header lines of p.
+// It returns a masked copy, or p if there is nothing to mask.
+func RedactHeaders(p []byte) []byte {
+	out := p
+	for start := 0; start < len(p); {
+		end := bytes.IndexByte(p[start:], '\n')
+		if end < 0 {
+			end = len(p)
+		} else {
+			end += start
+		}
+		line := bytes.TrimSuffix(p[start:end], []byte("\r"))
+		for _, h := range traceHeaders {
+			if len(line) > len(h) && bytes.EqualFold(line[:len(h)], h) {
+				if &out[0] == &p[0] {
+					out = append([]byte{}, p...)
+				}
+				for i := start + len(h); i < start+len(line); i++ {
+					if out[i] != ' ' {
+						out[i] = '*'
+					}
+				}
+			}
+		}
+		start = end + 1
+	}
+	return out
+}
+
+// redactor masks the credential header values of a stream of data read or written in chunks, like RedactHeaders.
+// It holds back the start of a line while it may still be a credential header name, so that the header
+// lines split across chunks are masked too.
+type redactor struct {
+	line    []byte // start of the current line, held back
+	pass    bool   // in a line to pass as is
+	masking bool   // in a credential header value
+}
+
+// redact returns the data of p to dump, masked, with the start of its last line held back if needed.
+func (r *redactor) redact(p []byte) []byte {
+	out := make([]byte, 0, len(r.line)+len(p))
+	for len(p) > 0 {
+		if r.pass || r.masking {
+			end := bytes.IndexByte(p, '\n') + 1
+			if end == 0 {
+				end = len(p)
+			}
+			start := len(out)
+			out = append(out, p[:end]...)
+			if r.masking {
+				for i := start; i < len(out); i++ {
+					if out[i] != ' ' && out[i] != '\r' && out[i] != '\n' {
+						out[i] = '*'
+					}
+				}
+			}
+			if out[len(out)-1] == '\n' {
+				r.pass, r.masking = false, false
+			}
+			p = p[end:]
+			continue
+		}
+		r.line = append(r.line, p[0])
+		p = p[1:]
+		if r.line[len(r.line)-1] == '\n' {
+			out = append(out, r.line...)
+			r.line = r.line[:0]
+			continue
+		}
+		prefix := false
+		for _, h := range traceHeaders {
+			if len(r.line) <= len(h) && bytes.EqualFold(r.line, h[:len(r.line)]) {
+				prefix = true
+				r.masking = len(r.line) == len(h)
+				break
+			}
+		}
+		if !prefix || r.masking {
+			r.pass = !prefix
+			out = append(out, r.line...)
+			r.line = r.line[:0]
+		}
+	}
+	return out
+}
+
+// flush returns the start of the line held back, at the end of the stream. It can't be a credential value.
+func (r *redactor) flush() []byte {
+	out := r.line
+	r.line = nil
+	r.pass, r.masking = false, false
+	return out
+}
@@ -0,0 +1,171 @@
+package spy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/metala/revwebsocks5/internal/tunnel"
+)
+
+const request = "GET / HTTP/1.1\r\nHost: example.com\r\nAuthorization: Basic c2VjcmV0\r\nCookie: id=secret\r\nX-Auth: visible\r\n\r\n"
+
+func TestRedactHeaders(t *testing.T) {
+	want := "GET / HTTP/1.1\r\nHost: example.com\r\nAuthorization: ***** ********\r\nCookie: *********\r\nX-Auth: visible\r\n\r\n"
+	if got := string(RedactHeaders([]byte(request))); got != want {
+		t.Errorf("RedactHeaders() = %q, want %q", got, want)
+	}
+}
+
+// TestRedactorChunks checks that the headers split across chunks are masked as RedactHeaders masks them whole.
+func TestRedactorChunks(t *testing.T) {
+	want := string(RedactHeaders([]byte(request)))
+	for size := 1; size <= len(request); size++ {
+		var r redactor
+		var out []byte
+		for p := []byte(request); len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			out = append(out, r.redact(p[:n])...)
+			p = p[n:]
+		}
+		if string(out) != want {
+			t.Fatalf("chunks of %d bytes redacted to %q, want %q", size, out, want)
+		}
+	}
+}
+
+func TestConnSpyRedacts(t *testing.T) {
+	var trace bytes.Buffer
+	tr := &Tracer{Output: &trace}
+	conn := tr.Conn(nopConn{}, "test")
+	for _, chunk := range []string{"GET / HTTP/1.1\r\nProxy-Autho", "rization: Basic c2VjcmV0\r\n\r\n"} {
+		conn.Write([]byte(chunk))
+	}
+	want := "GET / HTTP/1.1\r\nProxy-Authorization: ***** ********\r\n\r\n"
+	if got := unxxd(t, trace.String()); got != want {
+		t.Errorf("dumped %q, want %q", got, want)
+	}
+}
+
+// TestConnSpyFlushes checks that the start of a line held back by the redactors is dumped
+// when the stream ends mid-line.
+func TestConnSpyFlushes(t *testing.T) {
+	var trace bytes.Buffer
+	tr := &Tracer{Output: &trace}
+	conn := tr.Conn(nopConn{}, "test")
+	conn.Write([]byte("GET / HTTP/1.1\r\nCook"))
+	conn.Close()
+	if got, want := unxxd(t, trace.String()), "GET / HTTP/1.1\r\nCook"; got != want {
+		t.Errorf("dumped %q on close, want %q", got, want)
+	}
+
+	trace.Reset()
+	conn = tr.Conn(&readConn{Reader: strings.NewReader("HTTP/1.1 200 OK\r\nAuth")}, "test")
+	io.Copy(io.Discard, conn)
+	if got, want := unxxd(t, trace.String()), "HTTP/1.1 200 OK\r\nAuth"; got != want {
+		t.Errorf("dumped %q on EOF, want %q", got, want)
+	}
+}
+
+// TestDecodeConnFlushes checks that the start of a line held back by the redactor of a yamux stream
+// is dumped when the stream or the connection ends mid-line.
+func TestDecodeConnFlushes(t *testing.T) {
+	frame := func(flags uint16, id uint32, payload string) []byte {
+		b := []byte{0, tunnel.YamuxTypeData}
+		b = binary.BigEndian.AppendUint16(b, flags)
+		b = binary.BigEndian.AppendUint32(b, id)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+		return append(b, payload...)
+	}
+	var yamux []byte
+	yamux = append(yamux, frame(tunnel.YamuxFlagSYN, 1, "GET / HTTP/1.1\r\nCook")...)
+	yamux = append(yamux, frame(tunnel.YamuxFlagFIN, 1, "")...)
+	yamux = append(yamux, frame(tunnel.YamuxFlagSYN, 3, "\r\nProxy-Auth")...)
+
+	var trace bytes.Buffer
+	tr := &Tracer{Output: &trace, Payload: true}
+	conn := tr.Decode(nopConn{}, "test")
+	conn.Write([]byte("GET /tunnel HTTP/1.1\r\n\r\n"))
+	conn.Write(append([]byte{0x82, byte(len(yamux))}, yamux...))
+	if got, want := unxxd(t, trace.String()), "GET / HTTP/1.1\r\nCook\r\n"; got != want {
+		t.Errorf("dumped %q at the end of the stream, want %q", got, want)
+	}
+	conn.Close()
+	if got, want := unxxd(t, trace.String()), "GET / HTTP/1.1\r\nCook\r\nProxy-Auth"; got != want {
+		t.Errorf("dumped %q on close, want %q", got, want)
+	}
+}
+
+// unxxd returns the bytes of the hex dumps of the trace.
+func unxxd(t *testing.T, trace string) string {
+	t.Helper()
+	var out []byte
+	for _, line := range strings.Split(trace, "\n") {
+		_, dump, ok := strings.Cut(line, ": ")
+		if !ok || strings.Contains(line, "(): ") {
+			continue
+		}
+		for _, x := range strings.Fields(dump[:min(len(dump), 48)]) {
+			b, err := hex.DecodeString(x)
+			if err != nil {
+				t.Fatalf("bad hex dump line %q", line)
+			}
+			out = append(out, b...)
+		}
+	}
+	return string(out)
+}
+
+// TestTracerPrune checks that the oldest trace files are removed beyond MaxFiles, the existing ones included.
+func TestTracerPrune(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "20000101-000000-1-000001-old.log")
+	for _, name := range []string{old, old + ".1", filepath.Join(dir, "other.txt")} {
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := &Tracer{Dir: dir, MaxFiles: 3, MaxBackups: 1}
+	for i := 0; i < 5; i++ {
+		closeTrace(tr.Logger(fmt.Sprintf("conn %d", i)))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 4 || names[3] != "other.txt" ||
+		!strings.HasSuffix(names[0], "conn_2.log") || !strings.HasSuffix(names[2], "conn_4.log") {
+		t.Errorf("files %v, want the last 3 traces and other.txt", names)
+	}
+}
+
+// nopConn is a connection discarding the writes and reading EOF.
+type nopConn struct{ net.Conn }
+
+func (nopConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (nopConn) Write(p []byte) (int, error) { return len(p), nil }
+func (nopConn) Close() error                { return nil }
+
+// readConn is a connection reading from the reader.
+type readConn struct {
+	nopConn
+	io.Reader
+}
+
+func (c *readConn) Read(p []byte) (int, error) { return c.Reader.Read(p) }
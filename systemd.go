@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sdListenFdsStart = 3
+
+// sdListener is a listener passed by systemd socket activation with its FileDescriptorName.
+type sdListener struct {
+	net.Listener
+
+	name string
+}
+
+// sdListeners returns the listeners passed by systemd socket activation, if any.
+// The environment variables are unset so child processes don't inherit them.
+func sdListeners() ([]sdListener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]sdListener, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := sdListenFdsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, sdListener{ln, name})
+	}
+	return listeners, nil
+}
+
+// splitSdListeners picks the agent listener, named "agent" or else the first one, and the SOCKS5 listeners.
+func splitSdListeners(listeners []sdListener) (agent net.Listener, socks []net.Listener) {
+	idx := -1
+	for i, l := range listeners {
+		if l.name == "agent" {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 && len(listeners) > 0 {
+		idx = 0
+	}
+	for i, l := range listeners {
+		if i == idx {
+			agent = l.Listener
+		} else {
+			socks = append(socks, l.Listener)
+		}
+	}
+	return agent, socks
+}
+
+// sdNotify sends a state update to the systemd service manager.
+// It does nothing when not running under systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog keeps pinging the systemd watchdog at half of WATCHDOG_USEC, if it's enabled for the process.
+func sdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	slog.Debug("Pinging systemd watchdog", "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Failed to notify systemd watchdog", "err", err)
+			}
+		}
+	}()
+}
+
+// sdWatchdogInterval returns half of WATCHDOG_USEC, or 0 if the watchdog isn't enabled for the process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
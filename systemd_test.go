@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v, want nil", err)
+	}
+
+	addrs := []string{filepath.Join(t.TempDir(), "notify")}
+	if runtime.GOOS == "linux" {
+		addrs = append(addrs, fmt.Sprintf("@revwebsocks5-test-%d", os.Getpid()))
+	}
+	for _, addr := range addrs {
+		t.Run(addr, func(t *testing.T) {
+			name := addr
+			if strings.HasPrefix(name, "@") {
+				name = "\x00" + name[1:]
+			}
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+			if err != nil {
+				t.Skipf("unixgram socket: %v", err)
+			}
+			defer conn.Close()
+			t.Setenv("NOTIFY_SOCKET", addr)
+
+			if err := sdNotify("READY=1\nSTATUS=0 agents connected"); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 256)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != "READY=1\nSTATUS=0 agents connected" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"0", "", 0},
+		{"2000000", "", time.Second},
+		{"2000000", strconv.Itoa(os.Getpid()), time.Second},
+		{"2000000", strconv.Itoa(os.Getpid() + 1), 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := sdWatchdogInterval(); got != tt.want {
+			t.Errorf("sdWatchdogInterval() with WATCHDOG_USEC=%q WATCHDOG_PID=%q = %v, want %v", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
+
+// TestSdListeners passes the listeners to a child test process, as systemd does, at the file descriptors from 3.
+func TestSdListeners(t *testing.T) {
+	if os.Getenv("SD_LISTENERS_HELPER") != "" {
+		sdListenersHelper()
+		return
+	}
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	tests := []struct {
+		name     string
+		fdnames  string
+		agent    string
+		socks    []string
+		inherits bool
+	}{
+		{"named agent", "socks:agent:socks", addrs[1], []string{addrs[0], addrs[2]}, true},
+		{"first as agent", "", addrs[0], []string{addrs[1], addrs[2]}, true},
+		{"other process", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSdListeners$")
+			cmd.ExtraFiles = files
+			cmd.Env = append(os.Environ(), "SD_LISTENERS_HELPER=1", "LISTEN_FDS=3", "LISTEN_FDNAMES="+tt.fdnames)
+			if tt.inherits {
+				cmd.Env = append(cmd.Env, "SD_LISTENERS_PID=self")
+			}
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+			want := fmt.Sprintf("agent=%s socks=%s\n", tt.agent, strings.Join(tt.socks, ","))
+			if got := strings.SplitAfter(string(out), "\n")[0]; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// sdListenersHelper prints the listeners of the socket activation, with LISTEN_PID set to the process
+// for SD_LISTENERS_PID=self and to another process otherwise, and checks that the variables are unset.
+func sdListenersHelper() {
+	pid := os.Getpid() + 1
+	if os.Getenv("SD_LISTENERS_PID") == "self" {
+		pid = os.Getpid()
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	listeners, err := sdListeners()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			fmt.Println(v, "is still set")
+			os.Exit(1)
+		}
+	}
+	agent, socks := splitSdListeners(listeners)
+	var agentAddr string
+	if agent != nil {
+		agentAddr = agent.Addr().String()
+	}
+	var socksAddrs []string
+	for _, l := range socks {
+		socksAddrs = append(socksAddrs, l.Addr().String())
+	}
+	fmt.Printf("agent=%s socks=%s\n", agentAddr, strings.Join(socksAddrs, ","))
+}